@@ -0,0 +1,299 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package url
+
+// This file implements the conversion of internationalized host names
+// to and from their ASCII form, using the Punycode encoding of RFC 3492
+// for labels that are not pure ASCII, as IDNA (RFC 3490) requires.
+// Nameprep (RFC 3491) is not done: labels are only case folded with
+// strings.ToLower, and no other mapping or normalization is applied,
+// so a name must already be in the form to be encoded. The ASCII
+// characters of a label must be letters, digits or hyphens, and it may
+// not start or end with a hyphen.
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// acePrefix marks a label holding Punycode-encoded data.
+const acePrefix = "xn--"
+
+// Parameters of the Punycode bootstring encoding, from RFC 3492 §5.
+const (
+	punyBase        int32 = 36
+	punyTMin        int32 = 1
+	punyTMax        int32 = 26
+	punySkew        int32 = 38
+	punyDamp        int32 = 700
+	punyInitialBias int32 = 72
+	punyInitialN    int32 = 128
+	punyMaxInt      int32 = 1<<31 - 1
+)
+
+var errPunycodeOverflow = errors.New("punycode: overflow")
+
+// hostToASCII converts each label of the host name host to its ASCII
+// compatible form.
+func hostToASCII(host string) (string, error) {
+	return mapLabels(host, labelToASCII)
+}
+
+// hostToASCIILoose is like hostToASCII but does not restrict the ASCII
+// characters of the labels, as the WHATWG host parser does not.
+func hostToASCIILoose(host string) (string, error) {
+	return mapLabels(host, encodeLabel)
+}
+
+// hostToUnicode converts each ASCII compatible label of the host name
+// host back to Unicode.
+func hostToUnicode(host string) (string, error) {
+	return mapLabels(host, labelToUnicode)
+}
+
+// mapLabels applies f to each dot-separated label of host. A single
+// trailing dot, denoting the root, is allowed; other empty labels are not.
+func mapLabels(host string, f func(string) (string, error)) (string, error) {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if label == "" {
+			if i == len(labels)-1 && i > 0 {
+				break
+			}
+			return "", errors.New("idna: empty label in " + strconv.Quote(host))
+		}
+		var err error
+		if labels[i], err = f(label); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// labelToASCII checks that label is a valid host name label and
+// converts it to its ASCII compatible form.
+func labelToASCII(label string) (string, error) {
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c < utf8.RuneSelf && c != '-' && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return "", errors.New("idna: invalid character " + strconv.Quote(label[i:i+1]) + " in label " + strconv.Quote(label))
+		}
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return "", errors.New("idna: label " + strconv.Quote(label) + " starts or ends with '-'")
+	}
+	return encodeLabel(label)
+}
+
+// encodeLabel case folds label and, unless it is ASCII, encodes it
+// with Punycode.
+func encodeLabel(label string) (string, error) {
+	if !utf8.ValidString(label) {
+		return "", errors.New("idna: invalid UTF-8 in label " + strconv.Quote(label))
+	}
+	label = strings.ToLower(label)
+	if !isASCII(label) {
+		enc, err := punyEncode(label)
+		if err != nil {
+			return "", err
+		}
+		label = acePrefix + enc
+	}
+	if len(label) > 63 {
+		return "", errors.New("idna: label too long: " + strconv.Quote(label))
+	}
+	return label, nil
+}
+
+func labelToUnicode(label string) (string, error) {
+	if !isASCII(label) {
+		return label, nil
+	}
+	lower := strings.ToLower(label)
+	if !strings.HasPrefix(lower, acePrefix) {
+		return label, nil
+	}
+	dec, err := punyDecode(lower[len(acePrefix):])
+	if err != nil {
+		return "", errors.New("idna: invalid label " + strconv.Quote(label) + ": " + err.Error())
+	}
+	// The label must be what ToASCII would produce for the decoded
+	// name; in particular it must need the encoding at all.
+	if enc, err := labelToASCII(dec); err != nil || enc != lower {
+		return "", errors.New("idna: invalid label " + strconv.Quote(label))
+	}
+	return dec, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punyAdapt is the bias adaptation function of RFC 3492 §6.1.
+func punyAdapt(delta, numPoints int32, firstTime bool) int32 {
+	if firstTime {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := int32(0)
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyThreshold returns the threshold t for position k given bias.
+func punyThreshold(k, bias int32) int32 {
+	t := k - bias
+	if t < punyTMin {
+		return punyTMin
+	}
+	if t > punyTMax {
+		return punyTMax
+	}
+	return t
+}
+
+func punyEncodeDigit(d int32) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDecodeDigit(c byte) (int32, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return int32(c-'0') + 26, true
+	case 'A' <= c && c <= 'Z':
+		return int32(c - 'A'), true
+	case 'a' <= c && c <= 'z':
+		return int32(c - 'a'), true
+	}
+	return 0, false
+}
+
+// punyEncode returns the Punycode encoding of s, per RFC 3492 §6.3,
+// without the ACE prefix.
+func punyEncode(s string) (string, error) {
+	runes := []rune(s)
+	output := make([]byte, 0, len(s))
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			output = append(output, byte(r))
+		}
+	}
+	b := int32(len(output))
+	h := b
+	if b > 0 {
+		output = append(output, '-')
+	}
+	n, delta, bias := punyInitialN, int32(0), punyInitialBias
+	for int(h) < len(runes) {
+		m := punyMaxInt
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if m-n > (punyMaxInt-delta)/(h+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				if delta++; delta < 0 {
+					return "", errPunycodeOverflow
+				}
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				output = append(output, punyEncodeDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			output = append(output, punyEncodeDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(output), nil
+}
+
+// punyDecode decodes the Punycode string s, per RFC 3492 §6.2.
+func punyDecode(s string) (string, error) {
+	var output []rune
+	pos := 0
+	if i := strings.LastIndex(s, "-"); i >= 0 {
+		for j := 0; j < i; j++ {
+			if s[j] >= utf8.RuneSelf {
+				return "", errors.New("punycode: non-ASCII basic code point")
+			}
+			output = append(output, rune(s[j]))
+		}
+		pos = i + 1
+	}
+	i, n, bias := int32(0), punyInitialN, punyInitialBias
+	for pos < len(s) {
+		oldi, w := i, int32(1)
+		for k := punyBase; ; k += punyBase {
+			if pos == len(s) {
+				return "", errors.New("punycode: truncated input")
+			}
+			digit, ok := punyDecodeDigit(s[pos])
+			pos++
+			if !ok {
+				return "", errors.New("punycode: invalid digit " + strconv.Quote(s[pos-1:pos]))
+			}
+			if digit > (punyMaxInt-i)/w {
+				return "", errPunycodeOverflow
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > punyMaxInt/(punyBase-t) {
+				return "", errPunycodeOverflow
+			}
+			w *= punyBase - t
+		}
+		x := int32(len(output) + 1)
+		bias = punyAdapt(i-oldi, x, oldi == 0)
+		if i/x > punyMaxInt-n {
+			return "", errPunycodeOverflow
+		}
+		n += i / x
+		i %= x
+		if n > utf8.MaxRune || 0xd800 <= n && n <= 0xdfff {
+			return "", errors.New("punycode: invalid code point")
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+	return string(output), nil
+}
@@ -7,7 +7,13 @@
 package url
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -21,6 +27,28 @@ type Error struct {
 
 func (e *Error) Error() string { return e.Op + " " + e.URL + ": " + e.Err.Error() }
 
+// Unwrap returns the underlying error, so that code inspecting error
+// chains can reach the cause of e.
+func (e *Error) Unwrap() error { return e.Err }
+
+// Timeout reports whether the wrapped error is a timeout, for errors
+// that provide a Timeout method such as those from the net package.
+func (e *Error) Timeout() bool {
+	t, ok := e.Err.(interface {
+		Timeout() bool
+	})
+	return ok && t.Timeout()
+}
+
+// Temporary reports whether the wrapped error is temporary, for errors
+// that provide a Temporary method such as those from the net package.
+func (e *Error) Temporary() bool {
+	t, ok := e.Err.(interface {
+		Temporary() bool
+	})
+	return ok && t.Temporary()
+}
+
 func ishex(c byte) bool {
 	switch {
 	case '0' <= c && c <= '9':
@@ -52,6 +80,10 @@ const (
 	encodeUserPassword
 	encodeQueryComponent
 	encodeFragment
+	encodeQueryPercent // like encodeQueryComponent, but space is %20 and + is literal
+	encodeHost
+	encodeCookieValue // like encodeQueryPercent; not a Component
+	numEncodings      // one past the last mode, for sizing tables
 )
 
 type EscapeError string
@@ -60,43 +92,130 @@ func (e EscapeError) Error() string {
 	return "invalid URL escape " + strconv.Quote(string(e))
 }
 
+// An EscapeOffsetError is an EscapeError together with the byte offset
+// in the checked string at which the malformed escape starts. It is
+// returned by the unescaping functions, by the query parsers and,
+// wrapped in an *Error, by Parse, whose offsets are into the whole URL.
+type EscapeOffsetError struct {
+	EscapeError     // the malformed escape, up to three bytes
+	Offset      int // offset of its '%'
+}
+
+func (e *EscapeOffsetError) Error() string {
+	return e.EscapeError.Error() + " at offset " + strconv.Itoa(e.Offset)
+}
+
+// CheckEscapes reports whether every '%' in s begins a well-formed
+// percent-encoding. If not, it returns an *EscapeOffsetError for the
+// first one that does not, locating it in s, as unescaping functions
+// such as PathUnescape and Parse do.
+func CheckEscapes(s string) error {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			continue
+		}
+		if i+2 >= len(s) || !ishex(s[i+1]) || !ishex(s[i+2]) {
+			return &EscapeOffsetError{badEscape(s, i), i}
+		}
+		i += 2
+	}
+	return nil
+}
+
+// badEscape returns the EscapeError for the malformed escape starting
+// at s[i].
+func badEscape(s string, i int) EscapeError {
+	s = s[i:]
+	if len(s) > 3 {
+		s = s[0:3]
+	}
+	return EscapeError(s)
+}
+
+// shiftEscape adds off to the offset of err if it is an
+// *EscapeOffsetError, for an error from unescaping the part of a
+// longer string that starts at off.
+func shiftEscape(err error, off int) error {
+	if e, ok := err.(*EscapeOffsetError); ok {
+		return &EscapeOffsetError{e.EscapeError, e.Offset + off}
+	}
+	return err
+}
+
+// escapeTable records the result of computeShouldEscape for every
+// byte in every encoding mode.
+var escapeTable = makeEscapeTable()
+
+func makeEscapeTable() *[numEncodings][256]bool {
+	t := new([numEncodings][256]bool)
+	for mode := encodePath; mode < numEncodings; mode++ {
+		for c := 0; c < 256; c++ {
+			t[mode][c] = computeShouldEscape(byte(c), mode)
+		}
+	}
+	return t
+}
+
 // Return true if the specified character should be escaped when
-// appearing in a URL string, according to RFC 2396.
-// When 'all' is true the full range of reserved characters are matched.
+// appearing in a URL string, according to RFC 3986.
 func shouldEscape(c byte, mode encoding) bool {
-	// RFC 2396 §2.3 Unreserved characters (alphanum)
+	return escapeTable[mode][c]
+}
+
+// computeShouldEscape is the definition of shouldEscape, used to fill
+// in escapeTable.
+func computeShouldEscape(c byte, mode encoding) bool {
+	if c >= 0x80 && mode == encodeHost {
+		// An internationalized host name is written out in
+		// UTF-8, as it is displayed, rather than escaped.
+		return false
+	}
+	// RFC 3986 §2.3 Unreserved characters (ALPHA / DIGIT)
 	if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
 		return false
 	}
-	// TODO: Update the character sets after RFC 3986.
 	switch c {
-	case '-', '_', '.', '!', '~', '*', '\'', '(', ')': // §2.3 Unreserved characters (mark)
+	case '-', '.', '_', '~': // §2.3 Unreserved characters
 		return false
 
-	case '$', '&', '+', ',', '/', ':', ';', '=', '?', '@': // §2.2 Reserved characters (reserved)
+	case '!', '$', '&', '\'', '(', ')', '*', '+', ',', ';', '=': // §2.2 Reserved characters (sub-delims)
+		// The grammar allows the sub-delims unescaped in the
+		// path, userinfo, host and fragment.
+		switch mode {
+		case encodeQueryComponent, encodeQueryPercent, encodeCookieValue: // §3.4
+			// Form encoding gives & = + ; a meaning of their
+			// own, so escape all of them to be safe. A cookie
+			// value may not hold ',' or ';' at all.
+			return true
+		}
+		return false
+
+	case ':', '/', '?', '#', '[', ']', '@': // §2.2 Reserved characters (gen-delims)
 		// Different sections of the URL allow a few of
-		// the reserved characters to appear unescaped.
+		// the gen-delims to appear unescaped.
 		switch mode {
 		case encodePath: // §3.3
-			// The RFC allows : @ & = + $ but saves / ; , for assigning
-			// meaning to individual path segments. This package
-			// only manipulates the path as a whole, so we allow those
-			// last two as well. That leaves only ? to escape.
-			return c == '?'
-
-		case encodeUserPassword: // §3.2.2
-			// The RFC allows ; : & = + $ , in userinfo, so we must escape only @ and /.
-			// The parsing of userinfo treats : as special so we must escape that too.
-			return c == '@' || c == '/' || c == ':'
-
-		case encodeQueryComponent: // §3.4
-			// The RFC reserves (so we must escape) everything.
+			// A pchar may be : or @, and / separates segments.
+			// This package only manipulates the path as a whole,
+			// so all three are left alone.
+			return c == '?' || c == '#' || c == '[' || c == ']'
+
+		case encodeUserPassword: // §3.2.1
+			// The RFC allows : in userinfo, but the parsing of
+			// userinfo treats it as special, so escape all of them.
 			return true
 
-		case encodeFragment: // §4.1
-			// The RFC text is silent but the grammar allows
-			// everything, so escape nothing.
-			return false
+		case encodeQueryComponent, encodeQueryPercent, encodeCookieValue: // §3.4
+			return true
+
+		case encodeFragment: // §3.5
+			// A fragment is made of pchars, / and ?.
+			return c == '#' || c == '[' || c == ']'
+
+		case encodeHost: // §3.2.2
+			// The host is kept together with its port, and may
+			// be an IPv6 literal in brackets.
+			return c != ':' && c != '[' && c != ']'
 		}
 	}
 
@@ -114,52 +233,33 @@ func QueryUnescape(s string) (string, error) {
 // unescape unescapes a string; the mode specifies
 // which section of the URL string is being unescaped.
 func unescape(s string, mode encoding) (string, error) {
-	// Count %, check that they're well-formed.
-	n := 0
-	hasPlus := false
-	for i := 0; i < len(s); {
-		switch s[i] {
-		case '%':
-			n++
-			if i+2 >= len(s) || !ishex(s[i+1]) || !ishex(s[i+2]) {
-				s = s[i:]
-				if len(s) > 3 {
-					s = s[0:3]
-				}
-				return "", EscapeError(s)
-			}
-			i += 3
-		case '+':
-			hasPlus = mode == encodeQueryComponent
-			i++
-		default:
-			i++
-		}
+	// Find the first byte that needs decoding; if there is none,
+	// s is returned as is.
+	i := 0
+	for i < len(s) && s[i] != '%' && (s[i] != '+' || mode != encodeQueryComponent) {
+		i++
 	}
-
-	if n == 0 && !hasPlus {
+	if i == len(s) {
 		return s, nil
 	}
 
-	t := make([]byte, len(s)-2*n)
-	j := 0
-	for i := 0; i < len(s); {
-		switch s[i] {
-		case '%':
-			t[j] = unhex(s[i+1])<<4 | unhex(s[i+2])
-			j++
-			i += 3
-		case '+':
-			if mode == encodeQueryComponent {
-				t[j] = ' '
-			} else {
-				t[j] = '+'
+	// Decode the rest, validating escapes as they are met. The result
+	// is never longer than s.
+	t := make([]byte, i, len(s))
+	copy(t, s[:i])
+	for i < len(s) {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) || !ishex(s[i+1]) || !ishex(s[i+2]) {
+				return "", &EscapeOffsetError{badEscape(s, i), i}
 			}
-			j++
+			t = append(t, unhex(s[i+1])<<4|unhex(s[i+2]))
+			i += 3
+		case c == '+' && mode == encodeQueryComponent:
+			t = append(t, ' ')
 			i++
 		default:
-			t[j] = s[i]
-			j++
+			t = append(t, c)
 			i++
 		}
 	}
@@ -172,7 +272,77 @@ func QueryEscape(s string) string {
 	return escape(s, encodeQueryComponent)
 }
 
+// QueryEscapeComponent escapes the string so it can be safely placed
+// inside a URL query. Unlike QueryEscape, it encodes a space as "%20"
+// rather than '+', as expected by parsers following RFC 3986 rather
+// than HTML form encoding.
+func QueryEscapeComponent(s string) string {
+	return escape(s, encodeQueryPercent)
+}
+
+// EscapeCookieValue escapes the string so it can be safely used as a
+// cookie value: it escapes everything QueryEscape does, including ';'
+// and ',', and whitespace, writing a space as "%20". The result is
+// made of RFC 6265 cookie-octets and is decoded by
+// QueryUnescapeComponent.
+func EscapeCookieValue(s string) string {
+	return escape(s, encodeCookieValue)
+}
+
+// QueryUnescapeComponent does the inverse transformation of
+// QueryEscapeComponent, converting %AB into the byte 0xAB. Unlike
+// QueryUnescape, it leaves '+' unchanged, as RFC 3986 gives it no
+// special meaning in a query. It returns an error if any % is not
+// followed by two hexadecimal digits.
+func QueryUnescapeComponent(s string) (string, error) {
+	return unescape(s, encodeQueryPercent)
+}
+
+// PathEscape escapes the string so it can be safely placed inside a
+// URL path. Unlike QueryEscape, it encodes a space as "%20".
+func PathEscape(s string) string {
+	return escape(s, encodePath)
+}
+
+// PathUnescape does the inverse transformation of PathEscape, converting
+// %AB into the byte 0xAB. Unlike QueryUnescape, it leaves '+' unchanged.
+// It returns an error if any % is not followed by two hexadecimal digits.
+func PathUnescape(s string) (string, error) {
+	return unescape(s, encodePath)
+}
+
+// A Component selects the part of a URL a string is escaped for by
+// EscapeLower. Each part allows a different set of characters unescaped.
+type Component int
+
+const (
+	PathComponent         = Component(encodePath)           // as by PathEscape
+	UserinfoComponent     = Component(encodeUserPassword)   // a user name or password
+	QueryComponent        = Component(encodeQueryComponent) // as by QueryEscape
+	QueryPercentComponent = Component(encodeQueryPercent)   // as by QueryEscapeComponent
+	FragmentComponent     = Component(encodeFragment)       // a fragment
+	HostComponent         = Component(encodeHost)           // a host name
+)
+
+// EscapeLower escapes s for use in the URL component c, as the other
+// escaping functions do, but writes the hexadecimal digits of each
+// percent-encoding in lower case, as in "%2f", for the servers and
+// signature schemes that require it. RFC 3986 recommends upper case,
+// which the other functions use.
+func EscapeLower(s string, c Component) string {
+	// HostComponent is the last mode that is a Component.
+	if c < PathComponent || c > HostComponent {
+		panic("url: invalid Component " + strconv.Itoa(int(c)))
+	}
+	return escapeHex(s, encoding(c), "0123456789abcdef")
+}
+
 func escape(s string, mode encoding) string {
+	return escapeHex(s, mode, "0123456789ABCDEF")
+}
+
+// escapeHex is escape with the hexadecimal digits to write given as hex.
+func escapeHex(s string, mode encoding, hex string) string {
 	spaceCount, hexCount := 0, 0
 	for i := 0; i < len(s); i++ {
 		c := s[i]
@@ -198,8 +368,8 @@ func escape(s string, mode encoding) string {
 			j++
 		case shouldEscape(c, mode):
 			t[j] = '%'
-			t[j+1] = "0123456789ABCDEF"[c>>4]
-			t[j+2] = "0123456789ABCDEF"[c&15]
+			t[j+1] = hex[c>>4]
+			t[j+2] = hex[c&15]
 			j += 3
 		default:
 			t[j] = s[i]
@@ -218,14 +388,21 @@ func escape(s string, mode encoding) string {
 //
 //	scheme:opaque[?query][#fragment]
 //
+// EmptyAuthority records an authority that is present but empty, as in
+// "file:///etc/hosts", rather than absent, as in "file:/etc/hosts".
+// Both have an empty Host and the Path "/etc/hosts".
 type URL struct {
-	Scheme   string
-	Opaque   string    // encoded opaque data
-	User     *Userinfo // username and password information
-	Host     string
-	Path     string
-	RawQuery string // encoded query values, without '?'
-	Fragment string // fragment for references, without '#'
+	Scheme         string
+	Opaque         string    // encoded opaque data
+	User           *Userinfo // username and password information
+	Host           string
+	EmptyAuthority bool // "//" with no host, as in "file:///x"
+	Path           string
+	RawPath        string // encoded path hint (see EscapedPath method)
+	ForceQuery     bool   // append a query ('?') even if RawQuery is empty
+	RawQuery       string // encoded query values, without '?'
+	Fragment       string // fragment for references, without '#'
+	RawFragment    string // encoded fragment hint (see EscapedFragment method)
 }
 
 // User returns a Userinfo containing the provided username
@@ -271,13 +448,25 @@ func (u *Userinfo) Password() (string, bool) {
 // String returns the encoded userinfo information in the standard form
 // of "username[:password]".
 func (u *Userinfo) String() string {
-	s := escape(u.username, encodeUserPassword)
+	return u.StringWith(escapeUserPassword)
+}
+
+// StringWith is like String but uses escaper to encode the username
+// and password. It is intended for talking to endpoints that expect
+// credentials escaped differently than the standard form; escaper must
+// still escape ':' in the username for the result to be unambiguous.
+func (u *Userinfo) StringWith(escaper func(string) string) string {
+	s := escaper(u.username)
 	if u.passwordSet {
-		s += ":" + escape(u.password, encodeUserPassword)
+		s += ":" + escaper(u.password)
 	}
 	return s
 }
 
+func escapeUserPassword(s string) string {
+	return escape(s, encodeUserPassword)
+}
+
 // Maybe rawurl is of the form scheme:path.
 // (Scheme must be [a-zA-Z][a-zA-Z0-9+-.]*)
 // If so, return scheme, path; else return "", rawurl.
@@ -321,13 +510,118 @@ func split(s string, c byte, cutc bool) (string, string) {
 }
 
 // Parse parses rawurl into a URL structure.
-// The string rawurl is assumed not to have a #fragment suffix.
-// (Web browsers strip #fragment before sending the URL to a web server.)
-// The rawurl may be relative or absolute.
+// The rawurl may be relative or absolute, and may have a trailing
+// #fragment, which is decoded into the Fragment field.
 func Parse(rawurl string) (url *URL, err error) {
+	// Cut off #frag
+	u, frag := split(rawurl, '#', true)
+	if u == "" && u != rawurl {
+		// A bare "#frag" refers within the current document.
+		url = new(URL)
+	} else if url, err = parse(u, false); err != nil {
+		return nil, err
+	}
+	if frag == "" {
+		return url, nil
+	}
+	if stringContainsCTLByte(frag) {
+		return nil, &Error{"parse", rawurl, errors.New("invalid control character in URL")}
+	}
+	if err = url.setFragment(frag); err != nil {
+		return nil, &Error{"parse", rawurl, shiftEscape(err, len(u)+1)}
+	}
+	return url, nil
+}
+
+// ParseTrim is like Parse but first cleans up rawurl as web browsers
+// do, for input such as links copied from documents or taken from HTML
+// attributes: leading and trailing spaces and C0 control characters
+// are removed, as are tabs and newlines anywhere, as the WHATWG URL
+// Standard specifies. Parse itself rejects such input. Control
+// characters elsewhere are still an error.
+func ParseTrim(rawurl string) (url *URL, err error) {
+	return Parse(whatwgClean(rawurl))
+}
+
+// ParseNoFragment is like Parse but for URLs known to have no
+// #fragment, such as those taken from a protocol that strips it. Any
+// '#' in rawurl is an error rather than the start of a fragment, so a
+// '#' meant literally in the path or query must be escaped as "%23"
+// instead of being silently cut off.
+func ParseNoFragment(rawurl string) (url *URL, err error) {
+	if i := strings.Index(rawurl, "#"); i >= 0 {
+		return nil, &Error{"parse", rawurl, errors.New("unescaped '#' at offset " + strconv.Itoa(i) + " in URL without fragment")}
+	}
 	return parse(rawurl, false)
 }
 
+// A StrictError describes a violation of RFC 3986 rejected by
+// ParseStrict but tolerated by Parse.
+type StrictError struct {
+	Offset int    // byte offset of the violation in the URL
+	Reason string // description of the violation
+}
+
+func (e *StrictError) Error() string {
+	return e.Reason + " at offset " + strconv.Itoa(e.Offset)
+}
+
+// ParseStrict is like Parse but additionally rejects URLs that do not
+// conform to RFC 3986: every byte must be an unreserved or reserved
+// character or part of a well-formed percent-encoding, so that spaces,
+// backslashes, non-ASCII bytes and stray '%' characters are errors.
+// A colon before any '/', '?' or '#' must end a valid scheme, so that
+// "ht_tp://x" is an error rather than a relative path as for Parse.
+// Such violations are reported as an *Error wrapping a *StrictError.
+func ParseStrict(rawurl string) (url *URL, err error) {
+	if err := checkStrict(rawurl); err != nil {
+		return nil, &Error{"parse", rawurl, err}
+	}
+	return Parse(rawurl)
+}
+
+// checkStrict returns a *StrictError for the first byte of s that
+// cannot appear in an RFC 3986 URI reference.
+func checkStrict(s string) error {
+	if err := checkScheme(s); err != nil {
+		return err
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !ishex(s[i+1]) || !ishex(s[i+2]) {
+				return &StrictError{i, "malformed escape"}
+			}
+			i += 2
+		case isUnreserved(c) || strings.IndexRune(":/?#[]@!$&'()*+,;=", rune(c)) >= 0:
+		default:
+			return &StrictError{i, "invalid character " + strconv.Quote(s[i:i+1])}
+		}
+	}
+	return nil
+}
+
+// checkScheme returns a *StrictError if s has a colon before any '/',
+// '?' or '#', so that it was meant to begin with a scheme, but the
+// text before the colon is not a valid scheme. getscheme instead
+// takes such a URL to have no scheme at all.
+func checkScheme(s string) error {
+	end := strings.IndexAny(s, ":/?#")
+	if end <= 0 || s[end] != ':' {
+		return nil
+	}
+	for i := 0; i < end; i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return &StrictError{i, "invalid character " + strconv.Quote(s[i:i+1]) + " in scheme"}
+		}
+	}
+	return nil
+}
+
 // ParseRequest parses rawurl into a URL structure.  It assumes that
 // rawurl was received from an HTTP request, so the rawurl is interpreted
 // only as an absolute URI or an absolute path.
@@ -337,17 +631,40 @@ func ParseRequest(rawurl string) (url *URL, err error) {
 	return parse(rawurl, true)
 }
 
+// ParseRequestURI parses the request-target of an HTTP request line,
+// as received by a server or proxy. It accepts the origin form
+// ("/path?query"), in which a leading path is never taken for a scheme
+// or an authority, the absolute form ("http://host/path?query"), and
+// the asterisk form "*" of a server-wide OPTIONS request, which yields
+// a URL whose Path is "*". A request-target never has a #fragment.
+func ParseRequestURI(rawuri string) (*URL, error) {
+	if rawuri == "*" {
+		return &URL{Path: "*"}, nil
+	}
+	if strings.Contains(rawuri, "#") {
+		return nil, &Error{"parse", rawuri, errors.New("fragment in request URI")}
+	}
+	return parse(rawuri, true)
+}
+
 // parse parses a URL from a string in one of two contexts.  If
 // viaRequest is true, the URL is assumed to have arrived via an HTTP request,
 // in which case only absolute URLs or path-absolute relative URLs are allowed.
 // If viaRequest is false, all forms of relative URLs are allowed.
 func parse(rawurl string, viaRequest bool) (url *URL, err error) {
 	var rest string
+	var off int // offset of rest in rawurl, for escape errors
 
 	if rawurl == "" {
 		err = errors.New("empty url")
 		goto Error
 	}
+	// Raw control characters could end up in HTTP requests built
+	// from the URL; they must be percent-encoded.
+	if stringContainsCTLByte(rawurl) {
+		err = errors.New("invalid control character in URL")
+		goto Error
+	}
 	url = new(URL)
 
 	// Split off possible leading "http:", "mailto:", etc.
@@ -355,8 +672,14 @@ func parse(rawurl string, viaRequest bool) (url *URL, err error) {
 	if url.Scheme, rest, err = getscheme(rawurl); err != nil {
 		goto Error
 	}
+	off = len(rawurl) - len(rest)
 
-	rest, url.RawQuery = split(rest, '?', true)
+	if strings.HasSuffix(rest, "?") && strings.Count(rest, "?") == 1 {
+		url.ForceQuery = true
+		rest = rest[:len(rest)-1]
+	} else {
+		rest, url.RawQuery = split(rest, '?', true)
+	}
 
 	if !strings.HasPrefix(rest, "/") {
 		if url.Scheme != "" {
@@ -373,16 +696,29 @@ func parse(rawurl string, viaRequest bool) (url *URL, err error) {
 	if (url.Scheme != "" || !viaRequest) && strings.HasPrefix(rest, "//") && !strings.HasPrefix(rest, "///") {
 		var authority string
 		authority, rest = split(rest[2:], '/', false)
-		url.User, url.Host, err = parseAuthority(authority)
-		if err != nil {
+		if viaRequest && strings.Contains(authority, "@") {
+			// A request line has no business carrying
+			// credentials; they would only confuse logging
+			// and access checks.
+			err = errors.New("userinfo in request URI")
 			goto Error
 		}
-		if strings.Contains(url.Host, "%") {
-			err = errors.New("hexadecimal escape in host")
+		url.User, url.Host, err = parseAuthority(authority)
+		if err != nil {
+			err = shiftEscape(err, off+len("//"))
 			goto Error
 		}
+		url.EmptyAuthority = authority == ""
+		off += len("//") + len(authority)
+	} else if (url.Scheme != "" || !viaRequest) && strings.HasPrefix(rest, "///") {
+		// An empty authority followed by an absolute path, as in
+		// "file:///etc/hosts" or the reference "///x".
+		url.EmptyAuthority = true
+		rest = rest[2:]
+		off += 2
 	}
-	if url.Path, err = unescape(rest, encodePath); err != nil {
+	if err = url.setPath(rest); err != nil {
+		err = shiftEscape(err, off)
 		goto Error
 	}
 	return url, nil
@@ -391,23 +727,91 @@ Error:
 	return nil, &Error{"parse", rawurl, err}
 }
 
+// stringContainsCTLByte reports whether s contains any ASCII control
+// character (0x00-0x1f or 0x7f).
+func stringContainsCTLByte(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if b := s[i]; b < ' ' || b == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAuthority parses the authority component of a URL, of the form
+// [userinfo@]host[:port], as found between the "//" and the path.
+// The userinfo and the host are decoded.
+func ParseAuthority(authority string) (*Userinfo, string, error) {
+	user, host, err := parseAuthority(authority)
+	if err != nil {
+		return nil, "", &Error{"parse", authority, err}
+	}
+	return user, host, nil
+}
+
+// ParseHost parses host[:port] as found in the Host header of an HTTP
+// request, such as "example.com:8080" or "[::1]:443", and returns the
+// decoded host name, without the brackets of an IPv6 literal, and the
+// port, which is empty if not given. It reports an error if host is
+// empty, has userinfo, contains characters not allowed in a host, or
+// has a port that is not numeric.
+func ParseHost(host string) (hostname, port string, err error) {
+	h, err := checkHostHeader(host)
+	if err != nil {
+		return "", "", &Error{"parse", host, err}
+	}
+	hostname, port = splitHostPort(h)
+	return hostname, port, nil
+}
+
+// checkHostHeader validates and decodes host for ParseHost.
+func checkHostHeader(host string) (string, error) {
+	if host == "" {
+		return "", errors.New("empty host")
+	}
+	if strings.Contains(host, "@") {
+		return "", errors.New("userinfo in host")
+	}
+	// A Host header is ASCII; non-ASCII names must be escaped.
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c >= 0x80 || c != '%' && shouldEscape(c, encodeHost) {
+			return "", errors.New("invalid character " + strconv.Quote(host[i:i+1]) + " in host")
+		}
+	}
+	h, err := parseHost(host)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(h, ":") {
+		return "", errors.New("missing host name before port")
+	}
+	return h, nil
+}
+
 func parseAuthority(authority string) (user *Userinfo, host string, err error) {
 	if strings.Index(authority, "@") < 0 {
-		host = authority
+		host, err = parseHost(authority)
 		return
 	}
 	userinfo, host := split(authority, '@', true)
+	if host, err = parseHost(host); err != nil {
+		err = shiftEscape(err, len(userinfo)+1)
+		return
+	}
 	if strings.Index(userinfo, ":") < 0 {
 		if userinfo, err = unescape(userinfo, encodeUserPassword); err != nil {
 			return
 		}
 		user = User(userinfo)
 	} else {
+		// RFC 3986 §3.2.1: the first colon ends the user name; any
+		// others are part of the password.
 		username, password := split(userinfo, ':', true)
 		if username, err = unescape(username, encodeUserPassword); err != nil {
 			return
 		}
 		if password, err = unescape(password, encodeUserPassword); err != nil {
+			err = shiftEscape(err, len(username)+1)
 			return
 		}
 		user = UserPassword(username, password)
@@ -415,103 +819,669 @@ func parseAuthority(authority string) (user *Userinfo, host string, err error) {
 	return
 }
 
-// ParseWithReference is like Parse but allows a trailing #fragment.
-func ParseWithReference(rawurlref string) (url *URL, err error) {
-	// Cut off #frag
-	rawurl, frag := split(rawurlref, '#', true)
-	if url, err = Parse(rawurl); err != nil {
-		return nil, err
+// parseHost checks and decodes the host[:port] part of an authority.
+// A host starting with '[' must be an IPv6 literal closed by ']' and
+// followed by nothing but an optional ":port"; brackets are not allowed
+// anywhere else. The literal may hold only hex digits, ':' and '.',
+// and an optional zone. The port must be numeric. Percent-encodings in a
+// registered name are decoded, but, like the bytes written as they
+// are, may only stand for bytes allowed in a reg-name by RFC 3986
+// §3.2.2 or for non-ASCII bytes. Within an
+// IPv6 literal, '%' may only appear as "%25", the zone delimiter.
+// The brackets are kept in the returned host.
+func parseHost(host string) (string, error) {
+	if strings.HasPrefix(host, "[") {
+		i := strings.Index(host, "]")
+		if i < 0 {
+			return "", errors.New("missing ']' in host")
+		}
+		if strings.Contains(host[1:i], "[") {
+			return "", errors.New("unexpected '[' in host")
+		}
+		if rest := host[i+1:]; rest != "" && rest[0] != ':' {
+			return "", errors.New("invalid character " + strconv.Quote(rest[:1]) + " after IPv6 literal")
+		}
+		if strings.ContainsAny(host[i+1:], "[]") {
+			return "", errors.New("unexpected bracket in port")
+		}
+		if !validOptionalPort(host[i+1:]) {
+			return "", errors.New("invalid port " + strconv.Quote(host[i+1:]) + " after host")
+		}
+		literal := host[1:i]
+		addr := literal
+		if z := strings.Index(addr, "%"); z >= 0 {
+			addr = addr[:z]
+		}
+		if !validIPv6Chars(addr) {
+			return "", errors.New("invalid IPv6 literal " + strconv.Quote(host[:i+1]) + " in host")
+		}
+		if z := strings.Index(literal, "%"); z >= 0 {
+			// RFC 6874: an IPv6 zone identifier follows an
+			// escaped '%' and is itself percent-encoded.
+			zone, ok := parseZone(literal[z:])
+			if !ok {
+				return "", errors.New("invalid zone in IPv6 literal " + strconv.Quote(host[:i+1]))
+			}
+			return "[" + literal[:z] + "%" + zone + host[i:], nil
+		}
+		return host, nil
 	}
-	if frag == "" {
-		return url, nil
+	if strings.ContainsAny(host, "[]") {
+		return "", errors.New("unexpected bracket in host")
 	}
-	if url.Fragment, err = unescape(frag, encodeFragment); err != nil {
-		return nil, &Error{"parse", rawurlref, err}
+	port := ""
+	if i := strings.Index(host, ":"); i >= 0 {
+		host, port = host[:i], host[i:]
+		if !validOptionalPort(port) {
+			return "", errors.New("invalid port " + strconv.Quote(port) + " after host")
+		}
 	}
-	return url, nil
+	// Raw bytes follow the same rule as escaped ones, so that the
+	// host is written back out in a form that parses again.
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c != '%' && shouldEscape(c, encodeHost) {
+			return "", errors.New("invalid character " + strconv.Quote(host[i:i+1]) + " in host")
+		}
+	}
+	if !strings.Contains(host, "%") {
+		return host + port, nil
+	}
+	h, err := unescape(host, encodeHost)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] != '%' {
+			continue
+		}
+		c := unhex(host[i+1])<<4 | unhex(host[i+2])
+		if c < 0x80 && !isUnreserved(c) && strings.IndexRune("!$&'()*+,;=", rune(c)) < 0 {
+			return "", errors.New("invalid escape " + strconv.Quote(host[i:i+3]) + " in host")
+		}
+		i += 2
+	}
+	return h + port, nil
 }
 
-// String reassembles the URL into a valid URL string.
-func (u *URL) String() string {
-	// TODO: Rewrite to use bytes.Buffer
-	result := ""
-	if u.Scheme != "" {
-		result += u.Scheme + ":"
+// validIPv6Chars reports whether addr, the address of an IPv6 literal
+// without its brackets and zone, is non-empty and made only of hex
+// digits, ':' and, for an embedded IPv4 address, '.'.
+func validIPv6Chars(addr string) bool {
+	if addr == "" {
+		return false
 	}
-	if u.Opaque != "" {
-		result += u.Opaque
-	} else {
-		if u.Host != "" || u.User != nil {
-			result += "//"
-			if u := u.User; u != nil {
-				result += u.String() + "@"
-			}
-			result += u.Host
+	for i := 0; i < len(addr); i++ {
+		if c := addr[i]; c != ':' && c != '.' && !ishex(c) {
+			return false
 		}
-		result += escape(u.Path, encodePath)
 	}
-	if u.RawQuery != "" {
-		result += "?" + u.RawQuery
+	return true
+}
+
+// parseZone decodes the zone identifier part of an IPv6 literal,
+// "%25" followed by a non-empty ZoneID of RFC 6874. The decoded zone
+// may contain any byte but those that would not be escaped again
+// when the host is written out, other than unreserved characters.
+func parseZone(s string) (zone string, ok bool) {
+	if !strings.HasPrefix(s, "%25") || len(s) == len("%25") {
+		return "", false
 	}
-	if u.Fragment != "" {
-		result += "#" + escape(u.Fragment, encodeFragment)
+	s = s[len("%25"):]
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' && !isUnreserved(s[i]) {
+			return "", false
+		}
 	}
-	return result
+	zone, err := unescape(s, encodeHost)
+	if err != nil {
+		return "", false
+	}
+	for i := 0; i < len(zone); i++ {
+		if c := zone[i]; !isUnreserved(c) && !shouldEscape(c, encodeHost) {
+			return "", false
+		}
+	}
+	return zone, true
 }
 
-// Values maps a string key to a list of values.
-// It is typically used for query parameters and form values.
-// Unlike in the http.Header map, the keys in a Values map
-// are case-sensitive.
-type Values map[string][]string
-
-// Get gets the first value associated with the given key.
-// If there are no values associated with the key, Get returns
-// the empty string. To access multiple values, use the map
-// directly.
-func (v Values) Get(key string) string {
-	if v == nil {
-		return ""
+// validOptionalPort reports whether port is either an empty string
+// or matches /^:\d*$/. An empty port after the colon is accepted, as
+// RFC 3986 allows it; it means the scheme's default port.
+func validOptionalPort(port string) bool {
+	if port == "" {
+		return true
 	}
-	vs, ok := v[key]
-	if !ok || len(vs) == 0 {
-		return ""
+	if port[0] != ':' {
+		return false
 	}
-	return vs[0]
+	for _, b := range port[1:] {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
 }
 
-// Set sets the key to value. It replaces any existing
-// values.
-func (v Values) Set(key, value string) {
-	v[key] = []string{value}
+// ParseWithReference is like Parse. It predates Parse accepting a
+// trailing #fragment and is kept for compatibility.
+func ParseWithReference(rawurlref string) (url *URL, err error) {
+	return Parse(rawurlref)
 }
 
-// Add adds the key to value. It appends to any existing
-// values associated with key.
-func (v Values) Add(key, value string) {
-	v[key] = append(v[key], value)
+// setPath sets the Path and RawPath fields of the URL based on the
+// provided escaped path p. RawPath is only kept if p is not the
+// default encoding of the decoded path.
+func (u *URL) setPath(p string) error {
+	path, err := unescape(p, encodePath)
+	if err != nil {
+		return err
+	}
+	u.Path = path
+	if p == escape(path, encodePath) {
+		u.RawPath = ""
+	} else {
+		u.RawPath = p
+	}
+	return nil
 }
 
-// Del deletes the values associated with key.
-func (v Values) Del(key string) {
-	delete(v, key)
+// EscapedPath returns the escaped form of u.Path. In general there
+// are multiple possible escaped forms of any path. EscapedPath returns
+// u.RawPath when it is a valid escaping of u.Path. Otherwise
+// EscapedPath ignores u.RawPath and computes an escaped form on its own.
+// The String and RequestURI methods use EscapedPath to construct
+// their results.
+func (u *URL) EscapedPath() string {
+	if u.RawPath != "" && validEncoded(u.RawPath, encodePath) {
+		if p, err := unescape(u.RawPath, encodePath); err == nil && p == u.Path {
+			return u.RawPath
+		}
+	}
+	return escape(u.Path, encodePath)
 }
 
-// ParseQuery parses the URL-encoded query string and returns
-// a map listing the values specified for each key.
-// ParseQuery always returns a non-nil map containing all the
-// valid query parameters found; err describes the first decoding error
-// encountered, if any.
-func ParseQuery(query string) (m Values, err error) {
+// setFragment sets the Fragment and RawFragment fields of the URL
+// based on the provided escaped fragment f. RawFragment is only kept
+// if f is not the default encoding of the decoded fragment.
+func (u *URL) setFragment(f string) error {
+	frag, err := unescape(f, encodeFragment)
+	if err != nil {
+		return err
+	}
+	u.Fragment = frag
+	if f == escape(frag, encodeFragment) {
+		u.RawFragment = ""
+	} else {
+		u.RawFragment = f
+	}
+	return nil
+}
+
+// EscapedFragment returns the escaped form of u.Fragment.
+// In general there are multiple possible escaped forms of any fragment.
+// EscapedFragment returns u.RawFragment when it is a valid escaping of
+// u.Fragment. Otherwise EscapedFragment ignores u.RawFragment and
+// computes an escaped form on its own. The String method uses
+// EscapedFragment to construct its result.
+func (u *URL) EscapedFragment() string {
+	if u.RawFragment != "" && validEncoded(u.RawFragment, encodeFragment) {
+		if f, err := unescape(u.RawFragment, encodeFragment); err == nil && f == u.Fragment {
+			return u.RawFragment
+		}
+	}
+	return escape(u.Fragment, encodeFragment)
+}
+
+// validEncoded reports whether s is a valid encoded path or fragment,
+// according to mode: it contains only characters allowed unescaped in
+// that component, plus well-formed percent escapes.
+func validEncoded(s string, mode encoding) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) || !ishex(s[i+1]) || !ishex(s[i+2]) {
+				return false
+			}
+			i += 2
+		case shouldEscape(c, mode):
+			return false
+		}
+	}
+	return true
+}
+
+// String reassembles the URL into a valid URL string.
+func (u *URL) String() string {
+	return string(u.AppendString(nil))
+}
+
+// AppendString appends the string form of u, as returned by String,
+// to b and returns the extended buffer. It lets callers assembling
+// many URLs reuse one buffer instead of allocating a string for each.
+func (u *URL) AppendString(b []byte) []byte {
+	// Escape the components first so that the buffer needs to grow
+	// at most once.
+	var user, host, path, frag string
+	if u.Opaque != "" {
+		path = u.Opaque
+	} else {
+		if u.User != nil {
+			user = u.User.String()
+		}
+		host = escape(u.Host, encodeHost)
+		path = u.EscapedPath()
+	}
+	if u.Fragment != "" {
+		frag = u.EscapedFragment()
+	}
+	n := len(u.Scheme) + len("://") + len(user) + len("@") + len(host) +
+		len(path) + len("?") + len(u.RawQuery) + len("#") + len(frag)
+	if cap(b)-len(b) < n {
+		nb := make([]byte, len(b), len(b)+n)
+		copy(nb, b)
+		b = nb
+	}
+	if u.Scheme != "" {
+		b = append(b, u.Scheme...)
+		b = append(b, ':')
+	}
+	if u.Opaque == "" && (u.Host != "" || u.User != nil || u.EmptyAuthority) {
+		b = append(b, "//"...)
+		if u.User != nil {
+			b = append(b, user...)
+			b = append(b, '@')
+		}
+		b = append(b, host...)
+	} else if u.Opaque == "" && strings.HasPrefix(path, "//") {
+		// Without an authority, a path starting with "//" would
+		// be read back as one; "/." keeps it a path, as in
+		// WHATWG serialization.
+		b = append(b, "/."...)
+	}
+	b = append(b, path...)
+	if u.ForceQuery || u.RawQuery != "" {
+		b = append(b, '?')
+		b = append(b, u.RawQuery...)
+	}
+	if u.Fragment != "" {
+		b = append(b, '#')
+		b = append(b, frag...)
+	}
+	return b
+}
+
+// StringValid is like String but first checks that the result will be
+// a valid URL, returning an error instead of a string that does not
+// mean what u does. The scheme must match the RFC 3986 grammar
+// ALPHA *( ALPHA / DIGIT / "+" / "-" / "." ), the host must parse back
+// to itself, and Opaque and RawQuery must be validly escaped. The
+// path, fragment and userinfo are always escaped as needed.
+func (u *URL) StringValid() (string, error) {
+	if u.Scheme != "" && !validScheme(u.Scheme) {
+		return "", errors.New("invalid scheme " + strconv.Quote(u.Scheme))
+	}
+	if u.Opaque != "" {
+		if !validEncoded(u.Opaque, encodePath) {
+			return "", errors.New("invalid opaque data " + strconv.Quote(u.Opaque))
+		}
+	} else if u.Host != "" {
+		if h, err := parseHost(escape(u.Host, encodeHost)); err != nil || h != u.Host {
+			return "", errors.New("invalid host " + strconv.Quote(u.Host))
+		}
+	}
+	// A query may contain the same characters as a fragment.
+	if !validEncoded(u.RawQuery, encodeFragment) {
+		return "", errors.New("invalid query " + strconv.Quote(u.RawQuery))
+	}
+	return u.String(), nil
+}
+
+// validScheme reports whether s is a scheme as defined by RFC 3986 §3.1.
+func validScheme(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Clone returns a copy of u that shares no memory with it; in
+// particular the userinfo, if any, is copied as well.
+func (u *URL) Clone() *URL {
+	if u == nil {
+		return nil
+	}
+	v := *u
+	if u.User != nil {
+		user := *u.User
+		v.User = &user
+	}
+	return &v
+}
+
+// WithoutFragment returns a copy of u, sharing no memory with it, with
+// the fragment removed.
+func (u *URL) WithoutFragment() *URL {
+	v := u.Clone()
+	v.Fragment = ""
+	v.RawFragment = ""
+	return v
+}
+
+// WithPath returns a copy of u, sharing no memory with it, with its
+// path set to the decoded path p. RawPath is cleared, so the path is
+// escaped afresh when the URL is converted to a string.
+func (u *URL) WithPath(p string) *URL {
+	v := u.Clone()
+	v.Path = p
+	v.RawPath = ""
+	return v
+}
+
+// FragmentURL parses the fragment of u as a relative URL, as used for
+// the routes of single-page web applications: for "http://h/#/a/b?c=d"
+// it returns a URL with Path "/a/b" and RawQuery "c=d". The fragment
+// is parsed in its escaped form, given by EscapedFragment, so that it
+// is not decoded twice; "#/a%2Fb" has the single segment "a/b". A
+// missing fragment yields an empty URL. It returns an error if the
+// fragment begins with a scheme and so is not a relative URL.
+func (u *URL) FragmentURL() (*URL, error) {
+	frag := u.EscapedFragment()
+	if frag == "" {
+		return new(URL), nil
+	}
+	if scheme, _, _ := getscheme(frag); scheme != "" {
+		return nil, &Error{"parse", frag, errors.New("fragment is not a relative URL")}
+	}
+	return Parse(frag)
+}
+
+// Equal reports whether u and v are the same URL. The userinfo is
+// compared by value. Paths are compared in decoded form, except that
+// escapes which change the meaning of a path, such as "%2F" in place of
+// "/", make two paths differ; escapes of unreserved characters and the
+// case of hex digits do not. Fragments are compared the same way.
+func (u *URL) Equal(v *URL) bool {
+	if u == nil || v == nil {
+		return u == v
+	}
+	if u.Scheme != v.Scheme || u.Opaque != v.Opaque || u.Host != v.Host || u.EmptyAuthority != v.EmptyAuthority ||
+		u.Path != v.Path || u.ForceQuery != v.ForceQuery ||
+		u.RawQuery != v.RawQuery || u.Fragment != v.Fragment {
+		return false
+	}
+	if (u.User == nil) != (v.User == nil) || u.User != nil && *u.User != *v.User {
+		return false
+	}
+	return normalizeEscapes(u.EscapedPath()) == normalizeEscapes(v.EscapedPath()) &&
+		normalizeEscapes(u.EscapedFragment()) == normalizeEscapes(v.EscapedFragment())
+}
+
+// Redacted is like String but replaces any password with "xxxxx".
+// Only the password in u.User is redacted. It is intended for URLs
+// that are to be logged.
+func (u *URL) Redacted() string {
+	if u.User == nil {
+		return u.String()
+	}
+	if _, has := u.User.Password(); !has {
+		return u.String()
+	}
+	v := *u
+	v.User = UserPassword(v.User.Username(), "xxxxx")
+	return v.String()
+}
+
+// GoString returns a Go-syntax representation of u, listing its
+// fields, for use with the %#v verb. As in Redacted, any password is
+// replaced by "xxxxx".
+func (u *URL) GoString() string {
+	if u == nil {
+		return "(*url.URL)(nil)"
+	}
+	user := "nil"
+	if u.User != nil {
+		user = "url.User(" + strconv.Quote(u.User.username) + ")"
+		if u.User.passwordSet {
+			user = "url.UserPassword(" + strconv.Quote(u.User.username) + `, "xxxxx")`
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString("&url.URL{Scheme:" + strconv.Quote(u.Scheme))
+	buf.WriteString(", Opaque:" + strconv.Quote(u.Opaque))
+	buf.WriteString(", User:" + user)
+	buf.WriteString(", Host:" + strconv.Quote(u.Host))
+	buf.WriteString(", EmptyAuthority:" + strconv.FormatBool(u.EmptyAuthority))
+	buf.WriteString(", Path:" + strconv.Quote(u.Path))
+	buf.WriteString(", RawPath:" + strconv.Quote(u.RawPath))
+	buf.WriteString(", ForceQuery:" + strconv.FormatBool(u.ForceQuery))
+	buf.WriteString(", RawQuery:" + strconv.Quote(u.RawQuery))
+	buf.WriteString(", Fragment:" + strconv.Quote(u.Fragment))
+	buf.WriteString(", RawFragment:" + strconv.Quote(u.RawFragment) + "}")
+	return buf.String()
+}
+
+// Values maps a string key to a list of values.
+// It is typically used for query parameters and form values.
+// Unlike in the http.Header map, the keys in a Values map
+// are case-sensitive.
+type Values map[string][]string
+
+// Get gets the first value associated with the given key.
+// If there are no values associated with the key, Get returns
+// the empty string. To access multiple values, use the map
+// directly.
+func (v Values) Get(key string) string {
+	if v == nil {
+		return ""
+	}
+	vs, ok := v[key]
+	if !ok || len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
+
+// Set sets the key to value. It replaces any existing
+// values.
+func (v Values) Set(key, value string) {
+	v[key] = []string{value}
+}
+
+// Add adds the key to value. It appends to any existing
+// values associated with key.
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+// Del deletes the values associated with key.
+func (v Values) Del(key string) {
+	delete(v, key)
+}
+
+// Has checks whether a given key is set, even if its list of values
+// is empty.
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// Clone returns a copy of v whose value slices are not shared with v.
+// Clone of a nil Values is nil.
+func (v Values) Clone() Values {
+	if v == nil {
+		return nil
+	}
+	c := make(Values, len(v))
+	for k, vs := range v {
+		c[k] = append(make([]string, 0, len(vs)), vs...)
+	}
+	return c
+}
+
+// Merge returns a new Values holding the values of v combined with
+// those of other. For each key in other, its values are appended to
+// those v has for the key or, if override is true, replace them.
+// Neither v nor other is modified, and either may be nil; the result
+// is never nil.
+func (v Values) Merge(other Values, override bool) Values {
+	m := make(Values, len(v)+len(other))
+	for k, vs := range v {
+		m[k] = append(make([]string, 0, len(vs)), vs...)
+	}
+	for k, vs := range other {
+		if override {
+			m[k] = append(make([]string, 0, len(vs)), vs...)
+		} else {
+			m[k] = append(m[k], vs...)
+		}
+	}
+	return m
+}
+
+// ParseQuery parses the URL-encoded query string and returns
+// a map listing the values specified for each key.
+// ParseQuery always returns a non-nil map containing all the
+// valid query parameters found; err describes the first decoding error
+// encountered, if any.
+func ParseQuery(query string) (m Values, err error) {
+	m = make(Values)
+	err = parseQuery(m, query, formQuery)
+	return
+}
+
+// ParseQueryLimit is like ParseQuery but accepts at most maxParams
+// parameters, so that a server parsing a request body can bound the
+// memory spent on it. If query has more, ParseQueryLimit returns the
+// first maxParams of them and an error. Empty parameters, as between
+// "&&", are not counted.
+func ParseQueryLimit(query string, maxParams int) (m Values, err error) {
+	m = make(Values)
+	opts := formQuery
+	opts.limit, opts.maxPairs = true, maxParams
+	err = parseQuery(m, query, opts)
+	return
+}
+
+// ParseQuerySemicolon is like ParseQuery but also accepts ';' as a
+// separator between pairs, as older versions of this package and some
+// legacy servers do. New code should not use it: a frontend and a
+// backend that disagree on the role of ';' can be made to see
+// different parameters in the same request.
+func ParseQuerySemicolon(query string) (m Values, err error) {
+	m = make(Values)
+	opts := formQuery
+	opts.semicolon = true
+	err = parseQuery(m, query, opts)
+	return
+}
+
+// ParseQueryPlusPolicy is like ParseQuery but lets the caller decide
+// whether '+' is decoded as a space. Form submissions use that
+// convention (plusAsSpace true, as in ParseQuery), but a generic
+// RFC 3986 query component does not, in which case '+' is kept as is.
+func ParseQueryPlusPolicy(query string, plusAsSpace bool) (m Values, err error) {
 	m = make(Values)
-	err = parseQuery(m, query)
+	err = parseQuery(m, query, queryOptions{keyPlus: plusAsSpace, valuePlus: plusAsSpace})
 	return
 }
 
-func parseQuery(m Values, query string) (err error) {
+// ParseQueryValuePlus is like ParseQuery but decodes '+' as a space
+// only in values. A '+' in a key is kept literally, so "a+b=c+d"
+// yields the key "a+b" with the value "c d".
+func ParseQueryValuePlus(query string) (m Values, err error) {
+	m = make(Values)
+	err = parseQuery(m, query, queryOptions{valuePlus: true})
+	return
+}
+
+// ParseQueryReader is like ParseQuery but reads the URL-encoded query
+// from r, as when parsing an application/x-www-form-urlencoded body.
+// Input is consumed in chunks; a pair split across reads is held back
+// until it is complete, so only the longest single pair needs to be
+// buffered. A read error other than io.EOF stops parsing and is
+// returned along with the pairs parsed so far.
+func ParseQueryReader(r io.Reader) (m Values, err error) {
+	m = make(Values)
+	buf := make([]byte, 512)
+	var pending []byte
+	var rerr error
+	done := 0 // bytes of the query before pending, for escape errors
+	for rerr == nil {
+		var n int
+		n, rerr = r.Read(buf)
+		pending = append(pending, buf[:n]...)
+		// Parse everything up to the last separator; the rest may
+		// be the start of a pair continued by the next read.
+		i := len(pending) - 1
+		for i >= 0 && pending[i] != '&' {
+			i--
+		}
+		if i >= 0 {
+			if err1 := parseQuery(m, string(pending[:i]), formQuery); err1 != nil && err == nil {
+				err = shiftEscape(err1, done)
+			}
+			done += i + 1
+			pending = append(pending[:0], pending[i+1:]...)
+		}
+	}
+	if rerr != io.EOF {
+		return m, rerr
+	}
+	if err1 := parseQuery(m, string(pending), formQuery); err1 != nil && err == nil {
+		err = shiftEscape(err1, done)
+	}
+	return m, err
+}
+
+// queryUnescape unescapes a query key or value, decoding '+' as a
+// space only if plusAsSpace is set.
+func queryUnescape(s string, plusAsSpace bool) (string, error) {
+	if plusAsSpace {
+		return unescape(s, encodeQueryComponent)
+	}
+	// Only query components treat '+' specially.
+	return unescape(s, encodePath)
+}
+
+// queryOptions controls how parseQuery splits and decodes a query.
+type queryOptions struct {
+	semicolon bool // accept ';' as well as '&' between pairs
+	keyPlus   bool // decode '+' in keys as a space
+	valuePlus bool // decode '+' in values as a space
+	limit     bool // accept at most maxPairs pairs
+	maxPairs  int
+}
+
+// formQuery holds the options for parsing form-encoded data.
+var formQuery = queryOptions{keyPlus: true, valuePlus: true}
+
+// parseQuery adds the pairs of query to m.
+func parseQuery(m Values, query string, opts queryOptions) error {
+	return scanQuery(query, opts, func(p QueryPair) {
+		m[p.Key] = append(m[p.Key], p.Value)
+	})
+}
+
+// scanQuery calls f for each pair of query, in order. Pairs that fail
+// to decode are skipped; the last decoding error is returned. If
+// opts.limit is set, scanning stops with an error at the first pair
+// beyond opts.maxPairs.
+func scanQuery(query string, opts queryOptions, f func(QueryPair)) (err error) {
+	seps := "&"
+	if opts.semicolon {
+		seps = "&;"
+	}
+	n := 0
+	end := len(query)
 	for query != "" {
+		start := end - len(query) // offset of key, for escape errors
 		key := query
-		if i := strings.IndexAny(key, "&;"); i >= 0 {
+		if i := strings.IndexAny(key, seps); i >= 0 {
 			key, query = key[:i], key[i+1:]
 		} else {
 			query = ""
@@ -519,69 +1489,274 @@ func parseQuery(m Values, query string) (err error) {
 		if key == "" {
 			continue
 		}
+		if n++; opts.limit && n > opts.maxPairs {
+			return errors.New("more than " + strconv.Itoa(opts.maxPairs) + " query parameters")
+		}
+		// Split on the first unescaped '=' before unescaping, so that an
+		// encoded "%3D" remains part of the key.
 		value := ""
-		if i := strings.Index(key, "="); i >= 0 {
+		i := strings.Index(key, "=")
+		if i >= 0 {
 			key, value = key[:i], key[i+1:]
 		}
-		key, err1 := QueryUnescape(key)
+		key, err1 := queryUnescape(key, opts.keyPlus)
 		if err1 != nil {
-			err = err1
+			err = shiftEscape(err1, start)
 			continue
 		}
-		value, err1 = QueryUnescape(value)
+		value, err1 = queryUnescape(value, opts.valuePlus)
 		if err1 != nil {
-			err = err1
+			err = shiftEscape(err1, start+i+1)
 			continue
 		}
-		m[key] = append(m[key], value)
+		f(QueryPair{key, value, i < 0})
 	}
 	return err
 }
 
-// Encode encodes the values into ``URL encoded'' form.
-// e.g. "foo=bar&bar=baz"
+// Encode encodes the values into ``URL encoded'' form
+// ("bar=baz&foo=quux") sorted by key.
 func (v Values) Encode() string {
+	return v.EncodeSep('&')
+}
+
+// EncodeSep is like Encode but separates the pairs with sep, which
+// must be '&' or ';', for legacy endpoints that expect
+// "bar=baz;foo=quux". ParseQuerySemicolon decodes the result.
+func (v Values) EncodeSep(sep byte) string {
+	if sep != '&' && sep != ';' {
+		panic("url: invalid query separator " + strconv.Quote(string(sep)))
+	}
 	if v == nil {
 		return ""
 	}
-	parts := make([]string, 0, len(v)) // will be large enough for most uses
+	// Size the buffer for the unescaped pairs, which is exact
+	// unless some of them need escaping.
+	n := 0
+	keys := make([]string, 0, len(v))
 	for k, vs := range v {
-		prefix := QueryEscape(k) + "="
-		for _, v := range vs {
-			parts = append(parts, prefix+QueryEscape(v))
+		keys = append(keys, k)
+		for _, s := range vs {
+			n += len(k) + len("=") + len(s) + len("&")
+		}
+	}
+	sort.Strings(keys)
+	buf := bytes.NewBuffer(make([]byte, 0, n))
+	for _, k := range keys {
+		vs := v[k]
+		if len(vs) == 0 {
+			continue
+		}
+		key := QueryEscape(k)
+		for _, s := range vs {
+			if buf.Len() > 0 {
+				buf.WriteByte(sep)
+			}
+			buf.WriteString(key)
+			buf.WriteByte('=')
+			buf.WriteString(QueryEscape(s))
+		}
+	}
+	return buf.String()
+}
+
+// EncodeOmitEmpty is like Encode but leaves out keys that have no
+// non-empty value, as is convenient for sparse form data. A key with
+// at least one non-empty value is encoded with all its values,
+// including empty ones.
+func (v Values) EncodeOmitEmpty() string {
+	w := make(Values, len(v))
+	for k, vs := range v {
+		for _, s := range vs {
+			if s != "" {
+				w[k] = vs
+				break
+			}
 		}
 	}
+	return w.Encode()
+}
+
+// A QueryPair is a single decoded key/value pair of a query string.
+type QueryPair struct {
+	Key     string
+	Value   string
+	NoValue bool // the key appeared without "=", as in "?flag"
+}
+
+// encodeQueryPairs encodes pairs into ``URL encoded'' form, keeping
+// the order of pairs.
+func encodeQueryPairs(pairs []QueryPair) string {
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		if p.NoValue && p.Value == "" {
+			parts[i] = QueryEscape(p.Key)
+			continue
+		}
+		parts[i] = QueryEscape(p.Key) + "=" + QueryEscape(p.Value)
+	}
 	return strings.Join(parts, "&")
 }
 
-// resolvePath applies special path segments from refs and applies
-// them to base, per RFC 2396.
-func resolvePath(basepath string, refpath string) string {
-	base := strings.Split(basepath, "/")
-	refs := strings.Split(refpath, "/")
-	if len(base) == 0 {
-		base = []string{""}
+// OrderedValues is a list of query parameters that, unlike Values,
+// remembers the order in which they were added.
+type OrderedValues []QueryPair
+
+// Add appends the pair key=value to v.
+func (v *OrderedValues) Add(key, value string) {
+	*v = append(*v, QueryPair{Key: key, Value: value})
+}
+
+// Encode encodes the values into ``URL encoded'' form
+// ("foo=quux&bar=baz") in the order they were added.
+func (v OrderedValues) Encode() string {
+	return encodeQueryPairs(v)
+}
+
+// ParseQueryStrict parses the URL-encoded query string like ParseQuery,
+// but returns the pairs in their original order and records in NoValue
+// which keys appeared without an "=", so that "a" and "a=" are told
+// apart and survive a round trip through Encode. Pairs that fail to
+// decode are left out; err describes the last such failure.
+func ParseQueryStrict(query string) (v OrderedValues, err error) {
+	err = scanQuery(query, formQuery, func(p QueryPair) {
+		v = append(v, p)
+	})
+	return
+}
+
+// resolvePath merges the reference path ref with the base path base
+// and removes any "." and ".." segments from the result, following
+// RFC 3986 §5.2.3 and §5.2.4. An absolute ref replaces base entirely.
+// The result is an absolute path unless both base and ref are empty.
+func resolvePath(base, ref string) string {
+	var full string
+	if ref == "" {
+		full = base
+	} else if ref[0] != '/' {
+		i := strings.LastIndex(base, "/")
+		full = base[:i+1] + ref
+	} else {
+		full = ref
 	}
-	for idx, ref := range refs {
-		switch {
-		case ref == ".":
-			base[len(base)-1] = ""
-		case ref == "..":
-			newLen := len(base) - 1
-			if newLen < 1 {
-				newLen = 1
+	if full == "" {
+		return ""
+	}
+	// A leading '/' leaves an empty first segment, the root, which
+	// ".." never removes; "/..//x" is "//x", not "/x".
+	root := 0
+	if full[0] == '/' {
+		root = 1
+	}
+	var dst []string
+	src := strings.Split(full, "/")
+	for _, elem := range src {
+		switch elem {
+		case ".":
+			// drop
+		case "..":
+			if len(dst) > root {
+				dst = dst[:len(dst)-1]
 			}
-			base = base[0:newLen]
-			base[len(base)-1] = ""
 		default:
-			if idx == 0 || base[len(base)-1] == "" {
-				base[len(base)-1] = ref
-			} else {
-				base = append(base, ref)
-			}
+			dst = append(dst, elem)
 		}
 	}
-	return strings.Join(base, "/")
+	if last := src[len(src)-1]; last == "." || last == ".." {
+		// A final "." or ".." leaves a directory, so add the
+		// trailing slash.
+		dst = append(dst, "")
+	}
+	// Keep any empty segments, including leading ones, so that
+	// "/a//b" and "//a" stay as they are.
+	p := strings.Join(dst, "/")
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// Hostname returns u.Host without any port number.
+// If Host is an IPv6 literal with a port number, Hostname returns the
+// IPv6 literal without the square brackets. Any zone identifier is
+// kept, as in "fe80::1%eth0".
+func (u *URL) Hostname() string {
+	host, _ := splitHostPort(u.Host)
+	return host
+}
+
+// Port returns the port part of u.Host, without the leading colon.
+// If u.Host doesn't contain a port, Port returns an empty string.
+// The port is not checked to be numeric; a colon inside an IPv6
+// literal is never taken to start a port.
+func (u *URL) Port() string {
+	_, port := splitHostPort(u.Host)
+	return port
+}
+
+// SplitHostPort returns the results of Hostname and Port together:
+// u.Host split into host and port, with the brackets removed from an
+// IPv6 literal. If u.Host doesn't contain a port, port is empty.
+func (u *URL) SplitHostPort() (host, port string) {
+	return splitHostPort(u.Host)
+}
+
+// ASCIIHost returns u.Host with an internationalized host name
+// converted to its ASCII compatible (Punycode) form, as needed to look
+// it up or connect to it. Any port is kept as is, as are IPv6 literals.
+// It returns an error if a label is not valid UTF-8, has ASCII
+// characters other than letters, digits and hyphens, starts or ends
+// with a hyphen, or is too long. Nameprep (RFC 3491) is not done.
+func (u *URL) ASCIIHost() (string, error) {
+	return mapHostName(u.Host, hostToASCII)
+}
+
+// UnicodeHost returns u.Host with any ASCII compatible (Punycode)
+// labels of the host name converted back to Unicode, for display.
+// Any port is kept as is, as are IPv6 literals. It returns an error if
+// a label is not valid Punycode.
+func (u *URL) UnicodeHost() (string, error) {
+	return mapHostName(u.Host, hostToUnicode)
+}
+
+// CanonicalHost returns u.Host with an IPv4 address written in any of
+// the forms many resolvers accept, such as "0x7f.1", "017700000001" or
+// "2130706433", converted to dotted decimal, here "127.0.0.1". A host
+// whose last label is a number is taken for an IPv4 address and must be
+// a valid one; CanonicalHost returns an error otherwise. Registered
+// names and IPv6 literals are returned unchanged, as is any port.
+func (u *URL) CanonicalHost() (string, error) {
+	if strings.HasPrefix(u.Host, "[") {
+		return u.Host, nil
+	}
+	host, port := splitHostPort(u.Host)
+	if host == "" || !endsInNumber(host) {
+		return u.Host, nil
+	}
+	addr, err := parseIPv4(host)
+	if err != nil {
+		return "", err
+	}
+	if port != "" || strings.HasSuffix(u.Host, ":") {
+		addr += ":" + port
+	}
+	return addr, nil
+}
+
+// mapHostName applies f to the host name part of hostport.
+func mapHostName(hostport string, f func(string) (string, error)) (string, error) {
+	if hostport == "" || strings.HasPrefix(hostport, "[") {
+		return hostport, nil
+	}
+	host, port := hostport, ""
+	if i := strings.LastIndex(hostport, ":"); i >= 0 {
+		host, port = hostport[:i], hostport[i:]
+	}
+	host, err := f(host)
+	if err != nil {
+		return "", err
+	}
+	return host + port, nil
 }
 
 // IsAbs returns true if the URL is absolute.
@@ -601,50 +1776,252 @@ func (base *URL) Parse(ref string) (*URL, error) {
 }
 
 // ResolveReference resolves a URI reference to an absolute URI from
-// an absolute base URI, per RFC 2396 Section 5.2.  The URI reference
+// an absolute base URI, per RFC 3986 Section 5.2.  The URI reference
 // may be relative or absolute.  ResolveReference always returns a new
 // URL instance, even if the returned URL is identical to either the
 // base or reference. If ref is an absolute URL, then ResolveReference
-// ignores base and returns a copy of ref.
+// ignores base and returns a copy of ref with any dot segments
+// removed from its path.
 func (base *URL) ResolveReference(ref *URL) *URL {
 	if ref.IsAbs() {
 		url := *ref
+		// ref's path is a valid escaped path, so this cannot fail.
+		url.setPath(resolvePath(ref.EscapedPath(), ""))
 		return &url
 	}
 	// relativeURI = ( net_path | abs_path | rel_path ) [ "?" query ]
 	url := *base
+	url.ForceQuery = ref.ForceQuery
 	url.RawQuery = ref.RawQuery
 	url.Fragment = ref.Fragment
+	url.RawFragment = ref.RawFragment
 	if ref.Opaque != "" {
 		url.Opaque = ref.Opaque
 		url.User = nil
 		url.Host = ""
+		url.EmptyAuthority = false
 		url.Path = ""
 		return &url
 	}
-	if ref.Host != "" || ref.User != nil {
-		// The "net_path" case.
+	if ref.Host != "" || ref.User != nil || ref.EmptyAuthority {
+		// The "net_path" case: only the scheme comes from
+		// base, and an empty path stays empty.
 		url.Host = ref.Host
 		url.User = ref.User
+		url.EmptyAuthority = ref.EmptyAuthority
+		p := ""
+		if ref.Path != "" {
+			p = resolvePath(ref.EscapedPath(), "")
+		}
+		url.setPath(p)
+		return &url
 	}
-	if strings.HasPrefix(ref.Path, "/") {
-		// The "abs_path" case.
-		url.Path = ref.Path
-	} else {
-		// The "rel_path" case.
-		path := resolvePath(base.Path, ref.Path)
-		if !strings.HasPrefix(path, "/") {
-			path = "/" + path
+	if ref.Path == "" {
+		// A same-document reference, such as "#frag" or "?q",
+		// keeps the base path, and the base query unless it has
+		// one of its own (RFC 3986 §5.2.2).
+		if ref.RawQuery == "" && !ref.ForceQuery {
+			url.ForceQuery = base.ForceQuery
+			url.RawQuery = base.RawQuery
 		}
-		url.Path = path
+		return &url
+	}
+	// The "abs_path" or "rel_path" cases. Paths are merged in
+	// their escaped form, so that an escaped '/' stays one.
+	p := resolvePath(base.EscapedPath(), ref.EscapedPath())
+	if p == "" {
+		p = "/"
 	}
+	url.setPath(p)
 	return &url
 }
 
-// Query parses RawQuery and returns the corresponding values.
-func (u *URL) Query() Values {
-	v, _ := ParseQuery(u.RawQuery)
-	return v
+// MakeRelative is the inverse of ResolveReference: it returns the
+// shortest relative reference, such as "../x/y?q#f", that resolves
+// against base to target. The query and fragment are taken from
+// target. If the two differ in the spelling of the host or in the
+// userinfo, the result is a network-path reference such as "//h/x".
+// It returns an error if base and target are not the same origin, as
+// defined by SameOrigin, or if either is opaque, since then no
+// relative reference exists. It also returns an error if no reference
+// resolves to target exactly, as when target's path has dot segments,
+// such as "/..", that ResolveReference would remove.
+func (base *URL) MakeRelative(target *URL) (*URL, error) {
+	if base.Opaque != "" || target.Opaque != "" || !base.SameOrigin(target) {
+		return nil, errors.New("no relative reference from " + strconv.Quote(base.Redacted()) +
+			" to " + strconv.Quote(target.Redacted()))
+	}
+	ref := base.makeRelative(target)
+	if r := base.ResolveReference(ref); r.EscapedPath() != target.EscapedPath() ||
+		r.RawQuery != target.RawQuery || r.ForceQuery != target.ForceQuery {
+		return nil, errors.New("no relative reference from " + strconv.Quote(base.Redacted()) +
+			" resolves to " + strconv.Quote(target.Redacted()))
+	}
+	return ref, nil
+}
+
+// makeRelative returns the relative reference for MakeRelative, which
+// checks that it resolves to target.
+func (base *URL) makeRelative(target *URL) *URL {
+	ref := &URL{
+		RawQuery:    target.RawQuery,
+		ForceQuery:  target.ForceQuery,
+		Fragment:    target.Fragment,
+		RawFragment: target.RawFragment,
+	}
+	bp, tp := base.EscapedPath(), target.EscapedPath()
+	sameUser := (base.User == nil) == (target.User == nil) && (base.User == nil || *base.User == *target.User)
+	if base.Host != target.Host || !sameUser || tp == "" && bp != "" {
+		ref.Host = target.Host
+		if target.User != nil {
+			user := *target.User
+			ref.User = &user
+		}
+		ref.setPath(tp)
+		return ref
+	}
+	if bp == "" {
+		bp = "/"
+	}
+	if tp == "" {
+		tp = "/"
+	}
+	if tp == bp && (ref.RawQuery != "" || ref.ForceQuery || base.RawQuery == "" && !base.ForceQuery) {
+		// An empty path keeps the base path, and the base query
+		// unless the reference has one of its own.
+		return ref
+	}
+	// The reference merges with the base directory, which is
+	// compared after its dot segments are removed; a final ".."
+	// in bp is dropped by the merge, not applied.
+	ref.setPath(relativePath(resolvePath(bp[:strings.LastIndex(bp, "/")+1], ""), tp))
+	return ref
+}
+
+// relativePath returns the shortest escaped relative path that merges
+// with the absolute base path bp to give the absolute path tp.
+func relativePath(bp, tp string) string {
+	bdir := strings.Split(bp, "/")
+	bdir = bdir[:len(bdir)-1]
+	tsegs := strings.Split(tp, "/")
+	i := 0
+	for i < len(bdir) && i < len(tsegs)-1 && bdir[i] == tsegs[i] {
+		i++
+	}
+	rel := strings.Repeat("../", len(bdir)-i) + strings.Join(tsegs[i:], "/")
+	if len(tp) < len(rel) && !strings.HasPrefix(tp, "//") {
+		return tp
+	}
+	first := rel
+	if j := strings.Index(first, "/"); j >= 0 {
+		first = first[:j]
+	}
+	if first == "" || strings.Contains(first, ":") {
+		// Keep an empty first segment from making the path
+		// absolute or a colon from starting a scheme.
+		rel = "./" + rel
+	}
+	return rel
+}
+
+// Query parses RawQuery and returns the corresponding values.
+func (u *URL) Query() Values {
+	v, _ := ParseQuery(u.RawQuery)
+	return v
+}
+
+// A QueryCache remembers the parsed query of a URL so that handlers
+// reading several parameters parse RawQuery only once. The query is
+// parsed again if RawQuery has changed since the last call. Keeping
+// the cache outside URL leaves URL a plain value that is safe to copy.
+// A QueryCache is not safe for concurrent use.
+type QueryCache struct {
+	URL *URL
+
+	raw    string // RawQuery when values was parsed
+	values Values // nil until the first call to Query
+}
+
+// NewQueryCache returns a QueryCache for u.
+func NewQueryCache(u *URL) *QueryCache {
+	return &QueryCache{URL: u}
+}
+
+// Query returns the values of c.URL's query, as returned by URL.Query.
+// The map is shared by later calls until RawQuery changes, so callers
+// must not modify it.
+func (c *QueryCache) Query() Values {
+	if c.values == nil || c.raw != c.URL.RawQuery {
+		c.raw = c.URL.RawQuery
+		c.values = c.URL.Query()
+	}
+	return c.values
+}
+
+// Get returns the first value of the query parameter key, or the
+// empty string if there is none.
+func (c *QueryCache) Get(key string) string {
+	return c.Query().Get(key)
+}
+
+// SetQueryParam sets the query parameter key to value, replacing any
+// existing values, and returns u to allow chaining. The other
+// parameters are kept, and RawQuery is re-encoded by Values.Encode,
+// which sorts it by key.
+func (u *URL) SetQueryParam(key, value string) *URL {
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u
+}
+
+// AddQueryParam adds value to the query parameter key, keeping any
+// existing values, and returns u to allow chaining. Like SetQueryParam,
+// it re-encodes RawQuery sorted by key.
+func (u *URL) AddQueryParam(key, value string) *URL {
+	q := u.Query()
+	q.Add(key, value)
+	u.RawQuery = q.Encode()
+	return u
+}
+
+// OpaqueQuery parses the query of an opaque URL such as
+// "mailto:gopher@example.com?subject=Hi%20there" and returns the
+// corresponding values. As in RFC 6068, '+' stands for itself rather
+// than a space. For a URL that is not opaque, OpaqueQuery returns an
+// empty map.
+func (u *URL) OpaqueQuery() Values {
+	v := make(Values)
+	if u.Opaque != "" {
+		parseQuery(v, u.RawQuery, queryOptions{})
+	}
+	return v
+}
+
+// SortedQuery parses RawQuery like Query and returns the decoded
+// key/value pairs sorted by key and then by value. A key given more
+// than once yields one pair per value.
+func (u *URL) SortedQuery() [][2]string {
+	var pairs [][2]string
+	for k, vs := range u.Query() {
+		for _, v := range vs {
+			pairs = append(pairs, [2]string{k, v})
+		}
+	}
+	sort.Sort(byKeyValue(pairs))
+	return pairs
+}
+
+// byKeyValue sorts pairs by key, then by value.
+type byKeyValue [][2]string
+
+func (p byKeyValue) Len() int      { return len(p) }
+func (p byKeyValue) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byKeyValue) Less(i, j int) bool {
+	if p[i][0] != p[j][0] {
+		return p[i][0] < p[j][0]
+	}
+	return p[i][1] < p[j][1]
 }
 
 // RequestURI returns the encoded path?query or opaque?query
@@ -652,13 +2029,763 @@ func (u *URL) Query() Values {
 func (u *URL) RequestURI() string {
 	result := u.Opaque
 	if result == "" {
-		result = escape(u.Path, encodePath)
+		result = u.EscapedPath()
 		if result == "" {
 			result = "/"
 		}
 	}
-	if u.RawQuery != "" {
+	if u.ForceQuery || u.RawQuery != "" {
 		result += "?" + u.RawQuery
 	}
 	return result
 }
+
+// AbsoluteRequestURI returns the absolute-form request target
+// "scheme://host/path?query" for u, as sent to a forward proxy.
+// Unlike RequestURI it includes the scheme and host, which must both
+// be present. Userinfo and the fragment are never included.
+func (u *URL) AbsoluteRequestURI() (string, error) {
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.New("absolute request URI requires scheme and host")
+	}
+	return u.Scheme + "://" + escape(u.Host, encodeHost) + u.RequestURI(), nil
+}
+
+// SplitPath splits the path immediately following the final slash,
+// separating it into a directory and a file name component.
+// If there is no slash in the path, SplitPath returns an empty dir
+// and file set to the path. Both components are decoded. An escaped
+// slash, as in "a%2Fb", is part of a name and does not split it.
+func (u *URL) SplitPath() (dir, file string) {
+	p := u.EscapedPath()
+	i := strings.LastIndex(p, "/")
+	// EscapedPath is validly escaped, so these cannot fail.
+	dir, _ = unescape(p[:i+1], encodePath)
+	file, _ = unescape(p[i+1:], encodePath)
+	return
+}
+
+// splitHostPort separates hostport into host and port, the port being
+// whatever follows the last colon outside any IPv6 literal. Brackets
+// around an IPv6 literal are removed from host.
+func splitHostPort(hostport string) (host, port string) {
+	host = hostport
+	colon := strings.LastIndex(host, ":")
+	if colon >= 0 && strings.Index(host[colon:], "]") < 0 {
+		host, port = host[:colon], host[colon+1:]
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return
+}
+
+// ParseGitRemote extracts the components of a version control remote
+// given as an ssh:// or git:// URL, such as "ssh://git@host:22/org/repo.git".
+// The returned user and port are empty if not present in u, and
+// repoPath is the decoded path without its leading slash.
+func ParseGitRemote(u *URL) (user, host, port, repoPath string, err error) {
+	switch u.Scheme {
+	case "ssh", "git", "git+ssh", "ssh+git":
+	default:
+		return "", "", "", "", errors.New("unsupported remote scheme " + strconv.Quote(u.Scheme))
+	}
+	if u.Host == "" {
+		return "", "", "", "", errors.New("missing host in remote")
+	}
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	host, port = u.Hostname(), u.Port()
+	repoPath = strings.TrimLeft(u.Path, "/")
+	return
+}
+
+// defaultPorts maps a scheme to the port implied when a URL of that
+// scheme does not give one explicitly.
+var defaultPorts = map[string]string{
+	"ftp":   "21",
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// IsDefaultPort reports whether u.Host gives a port explicitly and
+// that port is the default for u.Scheme, so that removing it would not
+// change the meaning of u. An empty port, as in "host:", counts as the
+// default. A colon inside an IPv6 literal is never taken for a port.
+func (u *URL) IsDefaultPort() bool {
+	return stripDefaultPort(strings.ToLower(u.Scheme), u.Host) != u.Host
+}
+
+// StripDefaultPort returns a copy of u with the port removed from
+// u.Host if IsDefaultPort reports it to be the default for the scheme.
+func (u *URL) StripDefaultPort() *URL {
+	v := u.Clone()
+	v.Host = stripDefaultPort(strings.ToLower(u.Scheme), u.Host)
+	return v
+}
+
+// SameOrigin reports whether u and v have the same origin: the same
+// scheme, the same host name ignoring case, and the same port, where a
+// missing port stands for the default port of the scheme. Userinfo,
+// path, query and fragment are ignored, so "http://h/a" and
+// "http://user@H:80/b" are the same origin. A URL that is opaque or
+// has no host, such as "mailto:a@x" or "file:///x", has no origin to
+// share and is not the same origin as any URL.
+func (u *URL) SameOrigin(v *URL) bool {
+	if u == nil || v == nil {
+		return u == v
+	}
+	if u.Opaque != "" || v.Opaque != "" || u.Host == "" || v.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != strings.ToLower(v.Scheme) {
+		return false
+	}
+	uhost, uport := splitHostPort(u.Host)
+	vhost, vport := splitHostPort(v.Host)
+	if uport == "" {
+		uport = defaultPorts[scheme]
+	}
+	if vport == "" {
+		vport = defaultPorts[scheme]
+	}
+	return strings.EqualFold(uhost, vhost) && uport == vport
+}
+
+// IsSafeRedirect reports whether redirecting to the user-supplied
+// reference ref, resolved against base, stays on the origin of base as
+// defined by SameOrigin, so that it cannot be used for an open
+// redirect. Absolute and scheme-relative references to another origin,
+// and other schemes such as "javascript:", are unsafe. Since the
+// redirect is followed by a browser, ref must also stay on the origin
+// when resolved as ParseWHATWG would, which for instance takes
+// "/\evil.example" to name a host. It returns an error if ref does
+// not parse.
+func (base *URL) IsSafeRedirect(ref string) (bool, error) {
+	r := new(URL)
+	if ref != "" {
+		var err error
+		if r, err = Parse(ref); err != nil {
+			return false, err
+		}
+	}
+	if !base.SameOrigin(base.ResolveReference(r)) {
+		return false, nil
+	}
+	w, err := base.ParseWHATWG(ref)
+	return err == nil && base.SameOrigin(w), nil
+}
+
+// stripDefaultPort removes a trailing ":port" from hostport if port
+// is the default port for scheme. An empty port is removed as well.
+func stripDefaultPort(scheme, hostport string) string {
+	colon := strings.LastIndex(hostport, ":")
+	if colon < 0 || strings.Index(hostport[colon:], "]") >= 0 {
+		return hostport
+	}
+	if port := hostport[colon+1:]; port == "" || port == defaultPorts[scheme] {
+		return hostport[:colon]
+	}
+	return hostport
+}
+
+// Normalize returns a copy of u in the normal form of RFC 3986 §6.2.2
+// and §6.2.3: the scheme and host are lower case, a port that is empty
+// or the default for the scheme is removed, percent-encodings use upper
+// case hex digits and are only used where needed, dot segments are
+// removed from an absolute path, and an empty path following a host
+// becomes "/". URLs that normalize to the same string are equivalent.
+func (u *URL) Normalize() *URL {
+	v := *u
+	v.Scheme = strings.ToLower(v.Scheme)
+	v.Host = stripDefaultPort(v.Scheme, strings.ToLower(v.Host))
+	v.Opaque = normalizeEscapes(v.Opaque)
+	v.RawQuery = normalizeEscapes(v.RawQuery)
+	if v.Opaque == "" {
+		p := normalizeEscapes(u.EscapedPath())
+		if strings.HasPrefix(p, "/") {
+			p = resolvePath(p, "")
+		}
+		if p == "" && v.Host != "" {
+			p = "/"
+		}
+		// p came from a valid escaped path, so this cannot fail.
+		v.setPath(p)
+	}
+	v.setFragment(normalizeEscapes(u.EscapedFragment()))
+	return &v
+}
+
+// CacheKey returns a canonical string form of u suitable for use as
+// a cache or deduplication key. It is the string form of u.Normalize,
+// except that an empty query and the fragment are dropped.
+func (u *URL) CacheKey() string {
+	v := u.Normalize()
+	v.ForceQuery = false
+	v.Fragment = ""
+	v.RawFragment = ""
+	return v.String()
+}
+
+// DedupeURLs returns the URLs in urls with duplicates removed, as
+// determined by CacheKey. The first occurrence of each URL is kept,
+// and the order of the remaining URLs is preserved. Nil entries are
+// dropped.
+func DedupeURLs(urls []*URL) []*URL {
+	seen := make(map[string]bool, len(urls))
+	var out []*URL
+	for _, u := range urls {
+		if u == nil {
+			continue
+		}
+		key := u.CacheKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, u)
+	}
+	return out
+}
+
+// NestedTargets parses the values of the named query parameters of u
+// as URLs and returns them, in the order given by paramKeys and then
+// by value. Keys absent from the query are skipped. It is meant for
+// inspecting the targets of redirectors and proxies such as
+// "http://proxy/fetch?url=http://internal/". If any value fails to
+// parse, NestedTargets returns nil and the parse error.
+func (u *URL) NestedTargets(paramKeys ...string) ([]*URL, error) {
+	q := u.Query()
+	var targets []*URL
+	for _, key := range paramKeys {
+		for _, v := range q[key] {
+			t, err := Parse(v)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// SetQueryOrdered sets u.RawQuery to the encoding of pairs, in the
+// order given, rather than the key order used by Values.Encode.
+// It returns u.
+func (u *URL) SetQueryOrdered(pairs []QueryPair) *URL {
+	u.RawQuery = encodeQueryPairs(pairs)
+	return u
+}
+
+// Limits describes maximum lengths for the components of a URL, as
+// checked by CheckLimits. Lengths are measured in bytes of the encoded
+// form. A zero field means the component is not limited.
+type Limits struct {
+	Host     int // length of Host, including any port
+	Path     int // length of the escaped path, or of Opaque
+	Query    int // length of RawQuery
+	Fragment int // length of the escaped fragment
+	Total    int // length of the whole URL as returned by String
+}
+
+// CheckLimits reports whether the components of u fit within limits.
+// It returns an error describing the first limit exceeded, checking
+// host, path, query, fragment and total length in that order.
+func (u *URL) CheckLimits(limits Limits) error {
+	path := u.Opaque
+	if path == "" {
+		path = u.EscapedPath()
+	}
+	checks := []struct {
+		name     string
+		n, limit int
+	}{
+		{"host", len(escape(u.Host, encodeHost)), limits.Host},
+		{"path", len(path), limits.Path},
+		{"query", len(u.RawQuery), limits.Query},
+		{"fragment", len(u.EscapedFragment()), limits.Fragment},
+		{"url", len(u.String()), limits.Total},
+	}
+	for _, c := range checks {
+		if c.limit > 0 && c.n > c.limit {
+			return errors.New(c.name + " length " + strconv.Itoa(c.n) + " exceeds limit " + strconv.Itoa(c.limit))
+		}
+	}
+	return nil
+}
+
+// BasicAuthURL returns a copy of base with its userinfo set to the
+// given username and password. The credentials are escaped as needed
+// when the URL is converted to a string.
+func BasicAuthURL(base *URL, username, password string) *URL {
+	u := *base
+	u.User = UserPassword(username, password)
+	return &u
+}
+
+// BasicAuthHeader returns the value of an HTTP Authorization header
+// carrying the credentials in u's userinfo using the Basic scheme,
+// and whether u has userinfo at all. A missing password is sent as
+// an empty one.
+func (u *URL) BasicAuthHeader() (string, bool) {
+	if u.User == nil {
+		return "", false
+	}
+	password, _ := u.User.Password()
+	auth := u.User.Username() + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth)), true
+}
+
+// ParsePathOrURL interprets s, typically a command line argument,
+// either as a URL or as a local file name. If s parses as an absolute
+// URL it is returned as is. Otherwise s is taken to be a file name,
+// made absolute relative to the current directory, and returned as
+// a file URL with an empty authority, such as "file:///tmp/x".
+// Single-letter schemes are treated as Windows drive
+// letters rather than URL schemes.
+func ParsePathOrURL(s string) (*URL, error) {
+	if s == "" {
+		return nil, &Error{"parse", s, errors.New("empty path or url")}
+	}
+	if u, err := Parse(s); err == nil && len(u.Scheme) > 1 {
+		return u, nil
+	}
+	abs, err := filepath.Abs(s)
+	if err != nil {
+		return nil, &Error{"parse", s, err}
+	}
+	path := filepath.ToSlash(abs)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return &URL{Scheme: "file", EmptyAuthority: true, Path: path}, nil
+}
+
+// QueryDiff parses the query strings q1 and q2 and reports how they
+// differ: added holds the parameters present only in q2, removed those
+// present only in q1, and changed those present in both but with
+// different sets of values, as given by q2. The order of repeated
+// values does not matter. If either query fails to parse, err is the
+// first error encountered.
+func QueryDiff(q1, q2 string) (added, removed, changed Values, err error) {
+	v1, err1 := ParseQuery(q1)
+	v2, err2 := ParseQuery(q2)
+	if err = err1; err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	added, removed, changed = make(Values), make(Values), make(Values)
+	for k, vs := range v2 {
+		old, ok := v1[k]
+		switch {
+		case !ok:
+			added[k] = vs
+		case !sameValues(old, vs):
+			changed[k] = vs
+		}
+	}
+	for k, vs := range v1 {
+		if _, ok := v2[k]; !ok {
+			removed[k] = vs
+		}
+	}
+	return
+}
+
+// sameValues reports whether a and b hold the same values, ignoring order.
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseWithWarnings is like Parse but also returns a list of
+// human-readable warnings about conditions that are legal but
+// suspicious, such as embedded credentials, an explicit non-default
+// port, an upper case scheme, a host with a trailing dot, or encoded
+// slashes in the path. The error is reserved for inputs that do not
+// parse at all.
+func ParseWithWarnings(rawurl string) (*URL, []string, error) {
+	u, err := Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	var warnings []string
+	if u.Scheme != strings.ToLower(u.Scheme) {
+		warnings = append(warnings, "scheme "+strconv.Quote(u.Scheme)+" is not lower case")
+	}
+	if u.User != nil {
+		warnings = append(warnings, "url contains userinfo")
+	}
+	host, port := splitHostPort(u.Host)
+	if def, ok := defaultPorts[strings.ToLower(u.Scheme)]; ok && port != "" && port != def {
+		warnings = append(warnings, "non-default port "+port+" for scheme "+u.Scheme)
+	}
+	if strings.HasSuffix(host, ".") {
+		warnings = append(warnings, "host "+strconv.Quote(host)+" has a trailing dot")
+	}
+	if strings.Contains(strings.ToLower(u.RawPath), "%2f") {
+		warnings = append(warnings, "path contains encoded slash")
+	}
+	return u, warnings, nil
+}
+
+// isUnreserved reports whether c is an unreserved character per
+// RFC 3986 §2.3, which never needs to be percent-encoded.
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// normalizeEscapes rewrites the already-escaped string s into the
+// canonical form of RFC 3986 §6.2.2: escapes of unreserved characters
+// are decoded, the remaining escapes use upper case hex digits, and
+// characters that are neither unreserved nor reserved are escaped.
+// Reserved characters are left alone, since they may be delimiters.
+// A '%' not starting a valid escape is itself escaped.
+func normalizeEscapes(s string) string {
+	t := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && i+2 < len(s) && ishex(s[i+1]) && ishex(s[i+2]):
+			c = unhex(s[i+1])<<4 | unhex(s[i+2])
+			i += 2
+			if isUnreserved(c) {
+				t = append(t, c)
+			} else {
+				t = append(t, '%', "0123456789ABCDEF"[c>>4], "0123456789ABCDEF"[c&15])
+			}
+		case isUnreserved(c) || c != '%' && strings.IndexRune(":/?#[]@!$&'()*+,;=", rune(c)) >= 0:
+			t = append(t, c)
+		default:
+			t = append(t, '%', "0123456789ABCDEF"[c>>4], "0123456789ABCDEF"[c&15])
+		}
+	}
+	return string(t)
+}
+
+// ReEscape returns a copy of u whose encoded components use canonical
+// escaping: minimal percent-encoding with upper case hex digits. The
+// decoded Path and Fragment are always escaped this way by String;
+// ReEscape additionally rewrites the still-encoded Opaque and RawQuery.
+// It is useful before signing or comparing URLs that have been
+// modified programmatically.
+func (u *URL) ReEscape() *URL {
+	v := *u
+	v.Opaque = normalizeEscapes(v.Opaque)
+	v.RawPath = ""
+	v.RawQuery = normalizeEscapes(v.RawQuery)
+	v.RawFragment = ""
+	return &v
+}
+
+// MarshalBinary returns the string form of u as a byte slice.
+func (u *URL) MarshalBinary() (text []byte, err error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalBinary parses text as a URL and stores the result in u.
+// If text does not parse, u is left unchanged and the parse error
+// is returned.
+func (u *URL) UnmarshalBinary(text []byte) error {
+	u1, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*u = *u1
+	return nil
+}
+
+// GobEncode implements the gob.GobEncoder interface using MarshalBinary.
+func (u *URL) GobEncode() ([]byte, error) {
+	return u.MarshalBinary()
+}
+
+// GobDecode implements the gob.GobDecoder interface using UnmarshalBinary.
+func (u *URL) GobDecode(data []byte) error {
+	return u.UnmarshalBinary(data)
+}
+
+// MarshalText returns the string form of u as a byte slice, for
+// text-based encodings such as JSON. A nil URL marshals as empty text.
+func (u *URL) MarshalText() (text []byte, err error) {
+	if u == nil {
+		return []byte{}, nil
+	}
+	return []byte(u.String()), nil
+}
+
+// UnmarshalText parses text as a URL and stores the result in u.
+// Empty text yields the zero URL. If text does not parse, u is left
+// unchanged and the parse error is returned.
+func (u *URL) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*u = URL{}
+		return nil
+	}
+	return u.UnmarshalBinary(text)
+}
+
+// JoinPath returns a new URL with the provided path elements joined to
+// any existing path and the resulting path cleaned of any ./ or ../
+// elements. The elements are decoded strings and are escaped as
+// needed; the existing path keeps its escaping, so "%2F" stays one.
+// Repeated slashes are reduced to one, and a trailing slash on the
+// last element is kept.
+func (u *URL) JoinPath(elem ...string) *URL {
+	esc := make([]string, 0, len(elem)+1)
+	esc = append(esc, u.EscapedPath())
+	for _, e := range elem {
+		esc = append(esc, escape(e, encodePath))
+	}
+	elem = esc
+	var p string
+	if !strings.HasPrefix(elem[0], "/") && u.Host == "" && u.User == nil {
+		// Keep a relative path relative, but don't let ".."
+		// elements climb above its start.
+		elem[0] = "/" + elem[0]
+		p = path.Join(elem...)[1:]
+	} else {
+		// A path following a host must be absolute.
+		p = path.Join(elem...)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	// path.Join removes any trailing slashes; preserve one.
+	if strings.HasSuffix(elem[len(elem)-1], "/") && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	url := *u
+	// p is made of validly escaped parts, so this cannot fail.
+	url.setPath(p)
+	return &url
+}
+
+// JoinPath returns a URL string with the provided path elements joined to
+// the existing path of base and the resulting path cleaned of any ./ or ../
+// elements, as by the JoinPath method.
+func JoinPath(base string, elem ...string) (result string, err error) {
+	url, err := Parse(base)
+	if err != nil {
+		return
+	}
+	result = url.JoinPath(elem...).String()
+	return
+}
+
+// ParseData interprets u as a data URL as defined by RFC 2397 and
+// returns its lower-cased media type, the media type parameters, and
+// the decoded payload. If the media type is omitted it defaults to
+// "text/plain" with a charset parameter of "US-ASCII".
+func ParseData(u *URL) (mediatype string, params map[string]string, data []byte, err error) {
+	if strings.ToLower(u.Scheme) != "data" {
+		err = errors.New("not a data URL")
+		return
+	}
+	s := u.Opaque
+	if u.RawQuery != "" || u.ForceQuery {
+		s += "?" + u.RawQuery
+	}
+	i := strings.IndexRune(s, ',')
+	if i < 0 {
+		err = errors.New("missing comma in data URL")
+		return
+	}
+	header, payload := s[:i], s[i+1:]
+
+	params = make(map[string]string)
+	isBase64 := false
+	parts := strings.Split(header, ";")
+	if strings.Contains(parts[0], "/") {
+		mediatype = strings.ToLower(parts[0])
+	}
+	for j, p := range parts[1:] {
+		if j == len(parts)-2 && strings.ToLower(p) == "base64" {
+			isBase64 = true
+			break
+		}
+		k, v := split(p, '=', true)
+		if k == "" {
+			err = errors.New("invalid parameter in data URL")
+			return
+		}
+		if v, err = unescape(v, encodePath); err != nil {
+			return
+		}
+		params[strings.ToLower(k)] = v
+	}
+	if mediatype == "" {
+		mediatype = "text/plain"
+		if _, ok := params["charset"]; !ok {
+			params["charset"] = "US-ASCII"
+		}
+	}
+
+	if payload, err = unescape(payload, encodePath); err != nil {
+		return
+	}
+	if isBase64 {
+		data, err = base64.StdEncoding.DecodeString(payload)
+		return
+	}
+	data = []byte(payload)
+	return
+}
+
+// Build returns a URL with the given scheme, host, decoded path,
+// query values and decoded fragment, and no userinfo. The query is
+// encoded with query.Encode. A path following a host is made absolute.
+func Build(scheme, host, path string, query Values, fragment string) *URL {
+	if host != "" && path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return &URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     path,
+		RawQuery: query.Encode(),
+		Fragment: fragment,
+	}
+}
+
+// isSpecialScheme reports whether scheme is one of the schemes given
+// special treatment by web browsers, as listed in the WHATWG URL
+// standard.
+func isSpecialScheme(scheme string) bool {
+	switch strings.ToLower(scheme) {
+	case "ftp", "file", "http", "https", "ws", "wss":
+		return true
+	}
+	return false
+}
+
+// ParseBrowserCompat is like Parse but, as web browsers do, treats
+// backslashes before any query or fragment as forward slashes when
+// rawurl has no scheme or one of the schemes browsers give special
+// treatment, such as http and https. Thus "http:\\host\path" parses
+// the same as "http://host/path".
+func ParseBrowserCompat(rawurl string) (*URL, error) {
+	scheme, _, err := getscheme(rawurl)
+	if err != nil || scheme != "" && !isSpecialScheme(scheme) {
+		return Parse(rawurl)
+	}
+	end := strings.IndexAny(rawurl, "?#")
+	if end < 0 {
+		end = len(rawurl)
+	}
+	return Parse(strings.Replace(rawurl[:end], "\\", "/", -1) + rawurl[end:])
+}
+
+// A PathSegment is one segment of a URL path, with any matrix
+// parameters of the form ";key=value" that follow its name.
+type PathSegment struct {
+	Name   string // decoded segment name
+	Params Values // decoded matrix parameters, nil if there are none
+}
+
+// PathSegments splits the path of u into its segments and their
+// matrix parameters, so that "/cars;color=red;year=2012/engine" yields
+// the segments "cars", with parameters color and year, and "engine".
+// The path is split in its escaped form, so an escaped '/', ';' or '='
+// is part of a name, key or value rather than a delimiter. The empty
+// segment before the first slash of an absolute path is left out.
+func (u *URL) PathSegments() []PathSegment {
+	p := u.EscapedPath()
+	if p == "" {
+		return nil
+	}
+	if p[0] == '/' {
+		p = p[1:]
+	}
+	raw := strings.Split(p, "/")
+	segs := make([]PathSegment, len(raw))
+	for i, r := range raw {
+		parts := strings.Split(r, ";")
+		// The escaped path is valid, so unescaping cannot fail.
+		segs[i].Name, _ = unescape(parts[0], encodePath)
+		for _, param := range parts[1:] {
+			k, v := split(param, '=', true)
+			k, _ = unescape(k, encodePath)
+			v, _ = unescape(v, encodePath)
+			if segs[i].Params == nil {
+				segs[i].Params = make(Values)
+			}
+			segs[i].Params.Add(k, v)
+		}
+	}
+	return segs
+}
+
+// HasPathPrefix reports whether the path of u begins with the path
+// prefix at a segment boundary, so that "/foo" is a prefix of "/foo"
+// and "/foo/bar" but not of "/foobar". A trailing slash on either path
+// is ignored, and the prefix "/" matches any absolute path. Both paths
+// are split in their escaped form and the segments compared after
+// unescaping, so prefix should be escaped as returned by EscapedPath.
+// Since a "." or ".." segment, however it is spelled, can make a path
+// that looks like it has the prefix mean one that does not, as in
+// "/public/../admin", HasPathPrefix reports false if either path has
+// one. Such paths must be cleaned before they can match.
+func (u *URL) HasPathPrefix(prefix string) bool {
+	ps, ok := splitPathSegments(prefix)
+	if !ok || hasDotSegment(ps) {
+		return false
+	}
+	us, _ := splitPathSegments(u.EscapedPath())
+	if len(us) < len(ps) || hasDotSegment(us) {
+		return false
+	}
+	for i := range ps {
+		if ps[i] != us[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDotSegment reports whether any of the unescaped segments is "."
+// or "..".
+func hasDotSegment(segs []string) bool {
+	for _, seg := range segs {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPathSegments splits the escaped path p at its slashes, after
+// removing any trailing slash, and unescapes each segment. An absolute
+// path yields an empty first segment. It reports false if p is not
+// validly escaped.
+func splitPathSegments(p string) ([]string, bool) {
+	if strings.HasSuffix(p, "/") {
+		p = p[:len(p)-1]
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		var err error
+		if segs[i], err = unescape(seg, encodePath); err != nil {
+			return nil, false
+		}
+	}
+	return segs, true
+}
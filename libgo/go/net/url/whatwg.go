@@ -0,0 +1,500 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package url
+
+// Parsing as specified by the WHATWG URL Standard, which describes
+// how web browsers treat the URLs they are given. It is more forgiving
+// than RFC 3986 in some ways and stricter in others.
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ParseWHATWG parses rawurl, which must be absolute, as a web browser
+// would according to the WHATWG URL Standard. Unlike Parse, it removes
+// leading and trailing spaces and control characters, and tabs and
+// newlines anywhere, and lower-cases the scheme. It escapes characters
+// that are not allowed in a component rather than rejecting them, takes
+// a '%' not followed by two hexadecimal digits literally, and treats
+// "%2e" as '.' when removing dot segments.
+//
+// For the schemes browsers treat specially, such as http, backslashes
+// count as slashes and any number of slashes after the scheme introduce
+// the host. The host is converted to lower case ASCII and may not
+// contain forbidden characters; a host ending in a number must be an
+// IPv4 address, whose parts may be written in decimal, octal or
+// hexadecimal. The default port is removed and an empty path becomes "/".
+// A file URL without a host has EmptyAuthority set, so that it is
+// written as "file:///etc/hosts" while its Path is "/etc/hosts".
+func ParseWHATWG(rawurl string) (*URL, error) {
+	u, err := parseWHATWG(whatwgClean(rawurl))
+	if err != nil {
+		return nil, &Error{"parse", rawurl, err}
+	}
+	return u, nil
+}
+
+// ParseWHATWG parses ref in the context of the receiver as a web
+// browser would according to the WHATWG URL Standard. The reference
+// may be relative or absolute; see the ParseWHATWG function.
+func (base *URL) ParseWHATWG(ref string) (*URL, error) {
+	s := whatwgClean(ref)
+	special := isSpecialScheme(base.Scheme)
+	if scheme, rest, err := getscheme(s); err == nil && scheme != "" {
+		if !special || !strings.EqualFold(scheme, base.Scheme) ||
+			strings.HasPrefix(whatwgSlashes(rest), "/") {
+			return ParseWHATWG(ref)
+		}
+		// "http:path" is relative to an http base.
+		s = rest
+	}
+	if base.Opaque != "" && !strings.HasPrefix(s, "#") {
+		return nil, &Error{"parse", ref, errors.New("relative reference to opaque URL")}
+	}
+	if special {
+		s = whatwgSlashes(s)
+		if strings.HasPrefix(s, "//") {
+			// A scheme-relative reference; let the absolute
+			// parser deal with the extra slashes and the host.
+			return ParseWHATWG(base.Scheme + ":" + s)
+		}
+	}
+	// Escape what Parse would reject, and keep what is left of s
+	// from being taken for an absolute URL.
+	s = whatwgEscape(s, func(c byte) bool { return c < ' ' || c == 0x7f })
+	if scheme, _, _ := getscheme(s); scheme != "" {
+		s = "./" + s
+	}
+	r := new(URL)
+	if s != "" {
+		var err error
+		if r, err = Parse(s); err != nil {
+			return nil, err
+		}
+	}
+	return ParseWHATWG(base.ResolveReference(r).String())
+}
+
+// whatwgClean removes leading and trailing C0 control characters and
+// spaces from s, and all tabs and newlines.
+func whatwgClean(s string) string {
+	s = strings.TrimFunc(s, func(r rune) bool { return r <= ' ' })
+	if strings.ContainsAny(s, "\t\n\r") {
+		s = strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return -1
+			}
+			return r
+		}, s)
+	}
+	return s
+}
+
+// whatwgSlashes replaces backslashes in s by slashes up to any query
+// or fragment, as is done for the special schemes.
+func whatwgSlashes(s string) string {
+	end := strings.IndexAny(s, "?#")
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.Replace(s[:end], "\\", "/", -1) + s[end:]
+}
+
+// whatwgEscape percent-encodes the bytes of s for which shouldEscape
+// reports true, as well as any '%' that does not begin a well-formed
+// percent-encoding. The result is a valid encoding.
+func whatwgEscape(s string, shouldEscape func(byte) bool) string {
+	var t []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		esc := shouldEscape(c)
+		if c == '%' {
+			esc = i+2 >= len(s) || !ishex(s[i+1]) || !ishex(s[i+2])
+		}
+		if esc {
+			if t == nil {
+				t = append(make([]byte, 0, len(s)+8), s[:i]...)
+			}
+			t = append(t, '%', "0123456789ABCDEF"[c>>4], "0123456789ABCDEF"[c&15])
+		} else if t != nil {
+			t = append(t, c)
+		}
+	}
+	if t == nil {
+		return s
+	}
+	return string(t)
+}
+
+func parseWHATWG(s string) (*URL, error) {
+	scheme, rest, err := getscheme(s)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "" {
+		return nil, errors.New("missing protocol scheme")
+	}
+	u := &URL{Scheme: strings.ToLower(scheme)}
+	special := isSpecialScheme(u.Scheme)
+	if special {
+		rest = whatwgSlashes(rest)
+	}
+
+	var frag, query string
+	hasFrag, hasQuery := false, false
+	if i := strings.Index(rest, "#"); i >= 0 {
+		rest, frag, hasFrag = rest[:i], rest[i+1:], true
+	}
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, query, hasQuery = rest[:i], rest[i+1:], true
+	}
+
+	path := rest
+	switch {
+	case u.Scheme == "file":
+		if strings.HasPrefix(rest, "//") {
+			var authority string
+			authority, path = split(rest[2:], '/', false)
+			if u.Host, err = whatwgHost(authority, true); err != nil {
+				return nil, err
+			}
+			if u.Host == "localhost" {
+				u.Host = ""
+			}
+		}
+		// A file URL always has an authority, if only an empty one.
+		u.EmptyAuthority = u.Host == ""
+	case special:
+		// Any number of slashes, even none, introduce the host.
+		var authority string
+		authority, path = split(strings.TrimLeft(rest, "/"), '/', false)
+		if err = u.setAuthorityWHATWG(authority); err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("empty host")
+		}
+	case strings.HasPrefix(rest, "//"):
+		var authority string
+		authority, path = split(rest[2:], '/', false)
+		if err = u.setAuthorityWHATWG(authority); err != nil {
+			return nil, err
+		}
+	case !strings.HasPrefix(rest, "/"):
+		u.Opaque = whatwgEscape(rest, func(c byte) bool { return c < ' ' || c >= 0x7f })
+	}
+
+	if u.Opaque == "" {
+		if special && !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		path = whatwgEscape(path, func(c byte) bool { return shouldEscape(c, encodePath) })
+		path = whatwgRemoveDots(path)
+		// path is a valid escaped path, so this cannot fail.
+		u.setPath(path)
+	}
+	if hasQuery {
+		u.RawQuery = whatwgEscape(query, func(c byte) bool {
+			return c <= ' ' || c >= 0x7f || c == '"' || c == '#' || c == '<' || c == '>' ||
+				c == '\'' && special
+		})
+		u.ForceQuery = query == ""
+	}
+	if hasFrag {
+		u.setFragment(whatwgEscape(frag, func(c byte) bool { return shouldEscape(c, encodeFragment) }))
+	}
+	return u, nil
+}
+
+// setAuthorityWHATWG sets the userinfo and host of u from authority,
+// which is split at its last '@'.
+func (u *URL) setAuthorityWHATWG(authority string) error {
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo := authority[:i]
+		authority = authority[i+1:]
+		if userinfo != "" {
+			escapeUser := func(c byte) bool { return shouldEscape(c, encodeUserPassword) && c != ':' }
+			name, password := split(whatwgEscape(userinfo, escapeUser), ':', true)
+			// The escaping above made these valid encodings.
+			name, _ = unescape(name, encodeUserPassword)
+			password, _ = unescape(password, encodeUserPassword)
+			if strings.Contains(userinfo, ":") {
+				u.User = UserPassword(name, password)
+			} else {
+				u.User = User(name)
+			}
+		}
+	}
+
+	hostport := authority
+	port, hasPort := "", false
+	if strings.HasPrefix(hostport, "[") {
+		if i := strings.Index(hostport, "]"); i >= 0 {
+			if rest := hostport[i+1:]; rest != "" {
+				if rest[0] != ':' {
+					return errors.New("invalid character " + strconv.Quote(rest[:1]) + " after IPv6 literal")
+				}
+				hostport, port, hasPort = hostport[:i+1], rest[1:], true
+			}
+		}
+	} else if i := strings.Index(hostport, ":"); i >= 0 {
+		hostport, port, hasPort = hostport[:i], hostport[i+1:], true
+	}
+	host, err := whatwgHost(hostport, isSpecialScheme(u.Scheme))
+	if err != nil {
+		return err
+	}
+	if hasPort && port != "" {
+		if port, err = whatwgPort(port); err != nil {
+			return err
+		}
+		if port != defaultPorts[u.Scheme] {
+			host += ":" + port
+		}
+	}
+	u.Host = host
+	return nil
+}
+
+// whatwgPort checks that port is a number below 65536 and returns it
+// without leading zeros.
+func whatwgPort(port string) (string, error) {
+	n := 0
+	for i := 0; i < len(port); i++ {
+		c := port[i]
+		if c < '0' || c > '9' {
+			return "", errors.New("invalid port " + strconv.Quote(port))
+		}
+		if n = n*10 + int(c-'0'); n > 65535 {
+			return "", errors.New("port " + port + " out of range")
+		}
+	}
+	return strconv.Itoa(n), nil
+}
+
+// whatwgForbiddenHost lists the characters that may not appear in
+// any host. A domain also may not contain '%', DEL or control
+// characters.
+const whatwgForbiddenHost = "\x00\t\n\r #/:<>?@[\\]^|"
+
+// whatwgHost parses and decodes a host. For the special schemes the
+// host is a domain, converted to lower case ASCII, or an IPv4 address;
+// for others it is taken as is, apart from decoding.
+func whatwgHost(host string, special bool) (string, error) {
+	if strings.HasPrefix(host, "[") {
+		if !strings.HasSuffix(host, "]") || !validIPv6(host[1:len(host)-1]) {
+			return "", errors.New("invalid IPv6 literal " + strconv.Quote(host))
+		}
+		return strings.ToLower(host), nil
+	}
+	if !special {
+		if i := strings.IndexAny(host, whatwgForbiddenHost); i >= 0 {
+			return "", errors.New("invalid character " + strconv.Quote(host[i:i+1]) + " in host")
+		}
+		// The escaping makes this a valid encoding.
+		return unescape(whatwgEscape(host, func(c byte) bool { return c < ' ' || c >= 0x7f }), encodeHost)
+	}
+
+	domain, err := unescape(host, encodeHost)
+	if err != nil {
+		return "", err
+	}
+	if isASCII(domain) {
+		domain = strings.ToLower(domain)
+	} else if domain, err = hostToASCIILoose(domain); err != nil {
+		return "", err
+	}
+	for i := 0; i < len(domain); i++ {
+		if c := domain[i]; c < ' ' || c == '%' || c == 0x7f || strings.IndexRune(whatwgForbiddenHost, rune(c)) >= 0 {
+			return "", errors.New("invalid character " + strconv.Quote(domain[i:i+1]) + " in host")
+		}
+	}
+	if endsInNumber(domain) {
+		return parseIPv4(domain)
+	}
+	return domain, nil
+}
+
+// validIPv6 reports whether addr is an IPv6 address: eight groups of
+// one to four hex digits separated by colons, where one "::" may stand
+// for one or more zero groups and the last two groups may be written
+// as a dotted IPv4 address.
+func validIPv6(addr string) bool {
+	i := strings.Index(addr, "::")
+	if i < 0 {
+		n, ok := ipv6Groups(addr)
+		return ok && n == 8
+	}
+	left, right := addr[:i], addr[i+2:]
+	ln, lok := ipv6Groups(left)
+	rn, rok := ipv6Groups(right)
+	return lok && rok && !strings.Contains(left, ".") && ln+rn <= 7
+}
+
+// ipv6Groups counts the colon-separated groups of s, a part of an
+// IPv6 address, counting a trailing dotted IPv4 address as two. It
+// reports false if a group is malformed.
+func ipv6Groups(s string) (int, bool) {
+	if s == "" {
+		return 0, true
+	}
+	groups := strings.Split(s, ":")
+	n := 0
+	for j, g := range groups {
+		if j == len(groups)-1 && strings.Contains(g, ".") {
+			if !validDottedIPv4(g) {
+				return 0, false
+			}
+			n += 2
+			continue
+		}
+		if g == "" || len(g) > 4 {
+			return 0, false
+		}
+		for k := 0; k < len(g); k++ {
+			if !ishex(g[k]) {
+				return 0, false
+			}
+		}
+		n++
+	}
+	return n, true
+}
+
+// validDottedIPv4 reports whether s is an IPv4 address in the strict
+// form allowed inside an IPv6 address: four decimal numbers up to 255,
+// without leading zeros.
+func validDottedIPv4(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return false
+	}
+	for _, p := range parts {
+		if p == "" || len(p) > 3 || len(p) > 1 && p[0] == '0' {
+			return false
+		}
+		n := 0
+		for k := 0; k < len(p); k++ {
+			if p[k] < '0' || p[k] > '9' {
+				return false
+			}
+			n = n*10 + int(p[k]-'0')
+		}
+		if n > 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// endsInNumber reports whether the last label of host, ignoring one
+// trailing dot, is a decimal number or a hexadecimal one starting with
+// "0x", in which case the host must be an IPv4 address.
+func endsInNumber(host string) bool {
+	labels := strings.Split(host, ".")
+	last := labels[len(labels)-1]
+	if last == "" && len(labels) > 1 {
+		last = labels[len(labels)-2]
+	}
+	if last == "" {
+		return false
+	}
+	digits := last
+	if len(last) >= 2 && last[0] == '0' && (last[1] == 'x' || last[1] == 'X') {
+		for i := 2; i < len(last); i++ {
+			if !ishex(last[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseIPv4 parses host as an IPv4 address in the forms accepted by
+// inet_aton and the WHATWG URL Standard, with one to four dot-separated
+// parts, each in decimal, octal (leading "0") or hexadecimal (leading
+// "0x"), the last part filling the remaining bytes. It returns the
+// address in dotted decimal.
+func parseIPv4(host string) (string, error) {
+	parts := strings.Split(host, ".")
+	if parts[len(parts)-1] == "" && len(parts) > 1 {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) > 4 {
+		return "", errors.New("invalid IPv4 address " + strconv.Quote(host))
+	}
+	var addr uint64
+	for i, part := range parts {
+		n, ok := parseIPv4Number(part)
+		if !ok {
+			return "", errors.New("invalid IPv4 address " + strconv.Quote(host))
+		}
+		if i < len(parts)-1 {
+			if n > 255 {
+				return "", errors.New("invalid IPv4 address " + strconv.Quote(host))
+			}
+			addr |= n << uint(8*(3-i))
+			continue
+		}
+		if n >= 1<<uint(8*(5-len(parts))) {
+			return "", errors.New("invalid IPv4 address " + strconv.Quote(host))
+		}
+		addr |= n
+	}
+	return strconv.FormatUint(addr>>24, 10) + "." + strconv.FormatUint(addr>>16&0xff, 10) + "." +
+		strconv.FormatUint(addr>>8&0xff, 10) + "." + strconv.FormatUint(addr&0xff, 10), nil
+}
+
+// parseIPv4Number parses one part of an IPv4 address. Values too
+// large for any part are reported as 1<<32.
+func parseIPv4Number(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	base := uint64(10)
+	switch {
+	case len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X'):
+		base, s = 16, s[2:]
+	case len(s) >= 2 && s[0] == '0':
+		base, s = 8, s[1:]
+	}
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		d := uint64(unhex(s[i]))
+		if !ishex(s[i]) || d >= base {
+			return 0, false
+		}
+		if n = n*base + d; n > 1<<32 {
+			n = 1 << 32
+		}
+	}
+	return n, true
+}
+
+// whatwgRemoveDots removes dot segments from the escaped path p,
+// taking "%2e" for '.'.
+func whatwgRemoveDots(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		switch strings.ToLower(seg) {
+		case "%2e":
+			segs[i] = "."
+		case ".%2e", "%2e.", "%2e%2e":
+			segs[i] = ".."
+		}
+	}
+	return resolvePath(strings.Join(segs, "/"), "")
+}